@@ -0,0 +1,187 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+const (
+	DefaultAuthMethod  = "auth"
+	DefaultAuthTimeout = 30 * time.Second
+)
+
+// BearerToken returns token from "Authorization: Bearer <token>" header of
+// r. empty string is returned if there is no such header
+func BearerToken(r *http.Request) string {
+	const prefix = "bearer "
+
+	h := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// authentication is required if any of authenticators is set
+func (self *Server) authRequired() bool {
+	return self.options.Authenticator != nil ||
+		self.options.HTTPAuthenticator != nil
+}
+
+func (self *Server) authMethod() string {
+	if self.options.AuthMethod == "" {
+		return DefaultAuthMethod
+	}
+	return self.options.AuthMethod
+}
+
+func (self *Server) authTimeout() time.Duration {
+	if self.options.AuthTimeout == 0 {
+		return DefaultAuthTimeout
+	}
+	return self.options.AuthTimeout
+}
+
+// authenticateHTTP is used before creating session for http requests.
+// returns false if request is rejected (and response is already written)
+func (self *Server) authenticateHTTP(
+	w http.ResponseWriter,
+	r *http.Request,
+) (principal interface{}, authenticated bool, ok bool) {
+
+	if self.options.HTTPAuthenticator == nil {
+		return nil, false, true
+	}
+
+	principal, err := self.options.HTTPAuthenticator(r)
+	if err == nil && principal == nil && self.options.Authenticator == nil {
+		// session would have no way to authenticate
+		err = errors.New("no credentials")
+	}
+	if err != nil {
+		self.LogError("http: authentication failed for", r.RemoteAddr, ":", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false, false
+	}
+
+	return principal, principal != nil, true
+}
+
+// handleAuth processes AuthMethod request
+func (self *Session) handleAuth(ctx *RPCHandleContext) {
+
+	responder := ctx.Responder
+
+	principal, err := self.options.Server.options.Authenticator(ctx)
+	if err == nil && principal == nil {
+		err = ErrUnauthorized("authenticator returned no principal")
+	}
+
+	if err != nil {
+		responder.LogError("authentication failed:", err)
+		self.dropPrincipal()
+		if !ctx.Req.Notif {
+			rpc_err, ok := err.(*jsonrpc2.Error)
+			if !ok {
+				rpc_err = ErrUnauthorized(err.Error())
+			}
+			err = responder.ReplyWithError(rpc_err)
+			if err != nil {
+				responder.LogError("can't send error message to caller:", err)
+			}
+		}
+		return
+	}
+
+	self.SetPrincipal(principal)
+
+	responder.Log("authenticated")
+
+	if !ctx.Req.Notif {
+		err = responder.Reply(true)
+		if err != nil {
+			responder.LogError("can't send reply to caller:", err)
+		}
+	}
+}
+
+// SetPrincipal marks session as authenticated by principal. can be used by
+// application, which does authentication by itself
+func (self *Session) SetPrincipal(principal interface{}) {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	self.principal = principal
+	self.authenticated = true
+
+	if self.auth_timer != nil {
+		self.auth_timer.Stop()
+		self.auth_timer = nil
+	}
+}
+
+// dropPrincipal marks session as unauthenticated after failed
+// authentication, so failed re-authentication doesn't leave previous
+// principal in place. auth timer is restarted for authenticated sessions
+func (self *Session) dropPrincipal() {
+	self.auth_mutex.Lock()
+	was_authenticated := self.authenticated
+	self.principal = nil
+	self.authenticated = false
+	self.auth_mutex.Unlock()
+
+	if was_authenticated && self.options.Transport != TransportHTTP {
+		self.startAuthTimer()
+	}
+}
+
+// GetPrincipal returns whatever authenticator returned for this session.
+// nil if session isn't authenticated
+func (self *Session) GetPrincipal() interface{} {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	return self.principal
+}
+
+func (self *Session) IsAuthenticated() bool {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	return self.authenticated
+}
+
+// destroy session if it's not authenticated in time
+func (self *Session) startAuthTimer() {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	if self.authenticated {
+		return
+	}
+
+	self.auth_timer = time.AfterFunc(
+		self.options.Server.authTimeout(),
+		func() {
+			if !self.IsAuthenticated() {
+				self.LogError("authentication timeout")
+				self.Destroy()
+			}
+		},
+	)
+}
+
+func (self *Session) stopAuthTimer() {
+	self.auth_mutex.Lock()
+	defer self.auth_mutex.Unlock()
+
+	if self.auth_timer != nil {
+		self.auth_timer.Stop()
+		self.auth_timer = nil
+	}
+}
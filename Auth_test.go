@@ -0,0 +1,90 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPAuthenticatorWithoutCredentials(t *testing.T) {
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			HTTPAuthenticator: func(r *http.Request) (interface{}, error) {
+				token := BearerToken(r)
+				if token == "" {
+					return nil, nil
+				}
+				return token, nil
+			},
+		},
+		nil,
+	)
+
+	// nothing can authenticate session later, so request is rejected
+	code, _ := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusUnauthorized {
+		t.Fatal("unexpected status:", code)
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		"http://"+address+DefaultHTTPPostPath,
+		strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"a"}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status:", resp.StatusCode)
+	}
+}
+
+func TestFailedReauthenticationDropsPrincipal(t *testing.T) {
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			Authenticator: func(ctx *RPCHandleContext) (interface{}, error) {
+				var params []string
+				ParseParameters(nil, ctx.Req.Params, &params)
+				if len(params) != 1 || params[0] != "secret" {
+					return nil, errors.New("wrong password")
+				}
+				return "user", nil
+			},
+		},
+		nil,
+	)
+
+	_, body := testPost(
+		t,
+		address,
+		`[{"jsonrpc":"2.0","id":1,"method":"auth","params":["secret"]},`+
+			`{"jsonrpc":"2.0","id":2,"method":"a"},`+
+			`{"jsonrpc":"2.0","id":3,"method":"auth","params":["wrong"]},`+
+			`{"jsonrpc":"2.0","id":4,"method":"a"}]`,
+	)
+
+	for _, i := range []string{
+		`"id":1,"result":true`,
+		`"id":2,"result":1`,
+	} {
+		if !strings.Contains(body, i) {
+			t.Fatal("response doesn't contain", i, ":", body)
+		}
+	}
+
+	if strings.Contains(body, `"id":4,"result"`) {
+		t.Fatal("request is handled after failed authentication:", body)
+	}
+}
@@ -0,0 +1,147 @@
+package gojsonrpc2server
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultTLSReloadInterval = 10 * time.Second
+
+// CertificateReloader provides certificate for tls.Config.GetCertificate,
+// reloading it from files when they change. files are checked lazily on
+// handshakes, not more often than check_interval. if new files can't be
+// loaded, previous certificate continues to be used
+type CertificateReloader struct {
+	cert_file      string
+	key_file       string
+	check_interval time.Duration
+
+	logger Logger
+
+	cert       *tls.Certificate
+	cert_mtime time.Time
+	key_mtime  time.Time
+	last_check time.Time
+
+	mutex *sync.Mutex
+}
+
+// loads certificate immediately and returns error if it fails.
+// check_interval 0 means DefaultTLSReloadInterval. logger can be nil
+func NewCertificateReloader(
+	cert_file string,
+	key_file string,
+	check_interval time.Duration,
+	logger Logger,
+) (*CertificateReloader, error) {
+
+	if check_interval == 0 {
+		check_interval = DefaultTLSReloadInterval
+	}
+
+	self := &CertificateReloader{
+		cert_file:      cert_file,
+		key_file:       key_file,
+		check_interval: check_interval,
+		logger:         logger,
+		mutex:          &sync.Mutex{},
+	}
+
+	err := self.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return self, nil
+}
+
+func (self *CertificateReloader) log(level LogLevel, txt ...interface{}) {
+	if self.logger != nil {
+		self.logger.Log(level, logMessage(txt...))
+	}
+}
+
+// Reload loads certificate from files unconditionally
+func (self *CertificateReloader) Reload() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.reload()
+}
+
+// must be called with mutex locked
+func (self *CertificateReloader) reload() error {
+
+	cert_stat, err := os.Stat(self.cert_file)
+	if err != nil {
+		return err
+	}
+
+	key_stat, err := os.Stat(self.key_file)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(self.cert_file, self.key_file)
+	if err != nil {
+		return err
+	}
+
+	self.cert = &cert
+	self.cert_mtime = cert_stat.ModTime()
+	self.key_mtime = key_stat.ModTime()
+	self.last_check = time.Now()
+
+	return nil
+}
+
+// must be called with mutex locked
+func (self *CertificateReloader) checkFiles() {
+	now := time.Now()
+	if now.Sub(self.last_check) < self.check_interval {
+		return
+	}
+	self.last_check = now
+
+	cert_stat, err := os.Stat(self.cert_file)
+	if err != nil {
+		self.log(LogLevelError, "certificate reloader:", err)
+		return
+	}
+
+	key_stat, err := os.Stat(self.key_file)
+	if err != nil {
+		self.log(LogLevelError, "certificate reloader:", err)
+		return
+	}
+
+	if cert_stat.ModTime().Equal(self.cert_mtime) &&
+		key_stat.ModTime().Equal(self.key_mtime) {
+		return
+	}
+
+	err = self.reload()
+	if err != nil {
+		self.log(
+			LogLevelError,
+			"certificate reloader: can't load new certificate. old one is kept:",
+			err,
+		)
+		return
+	}
+
+	self.log(LogLevelInfo, "certificate reloader: certificate reloaded from", self.cert_file)
+}
+
+func (self *CertificateReloader) GetCertificate(
+	hello *tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.checkFiles()
+
+	return self.cert, nil
+}
@@ -0,0 +1,70 @@
+package gojsonrpc2server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"time"
+)
+
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// CertificateIdentity is identity of client, taken from verified client
+// certificate. Use tls.Config.ClientAuth = tls.RequireAndVerifyClientCert
+// (or VerifyClientCertIfGiven) in ServerOptions.TLSConfig to get it
+type CertificateIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+
+	// leaf of first verified chain
+	Certificate *x509.Certificate
+}
+
+func NewCertificateIdentity(cert *x509.Certificate) *CertificateIdentity {
+	self := &CertificateIdentity{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Certificate:    cert,
+	}
+	return self
+}
+
+// GetTLSConnectionState returns nil if session's connection isn't TLS
+func (self *Session) GetTLSConnectionState() *tls.ConnectionState {
+	return self.options.TLSConnectionState
+}
+
+// GetVerifiedChains returns client certificate chains verified by
+// server. nil if client certificate wasn't provided or verified
+func (self *Session) GetVerifiedChains() [][]*x509.Certificate {
+	if self.options.TLSConnectionState == nil {
+		return nil
+	}
+	return self.options.TLSConnectionState.VerifiedChains
+}
+
+// GetClientIdentity returns identity from verified client certificate.
+// nil if there is no verified client certificate
+func (self *Session) GetClientIdentity() *CertificateIdentity {
+	chains := self.GetVerifiedChains()
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return NewCertificateIdentity(chains[0][0])
+}
+
+// ClientIdentity is shortcut for ctx.Session.GetClientIdentity()
+func (self *RPCHandleContext) ClientIdentity() *CertificateIdentity {
+	if self.Session == nil {
+		return nil
+	}
+	return self.Session.GetClientIdentity()
+}
@@ -0,0 +1,64 @@
+package gojsonrpc2server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// NewlineObjectCodec reads/writes JSON-RPC 2.0 objects as single line JSON
+// texts separated with '\n'. Suitable for clients like `nc`.
+//
+// jsonrpc2.PlainObjectCodec is not used for this, as it creates new
+// json.Decoder for each object, which may read ahead and loose data
+type NewlineObjectCodec struct{}
+
+var _ jsonrpc2.ObjectCodec = NewlineObjectCodec{}
+
+func (NewlineObjectCodec) WriteObject(stream io.Writer, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = stream.Write(data)
+	return err
+}
+
+func (NewlineObjectCodec) ReadObject(stream *bufio.Reader, v interface{}) error {
+	for {
+		line, err := stream.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 {
+			return json.Unmarshal(line, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+const (
+	CodecNameVarint        = "varint"
+	CodecNameNewline       = "newline"
+	CodecNameContentLength = "content-length"
+)
+
+// CodecByName returns codec by it's name. Useful for configuration files.
+// Empty name means "varint"
+func CodecByName(name string) (jsonrpc2.ObjectCodec, error) {
+	switch name {
+	case "", CodecNameVarint:
+		return jsonrpc2.VarintObjectCodec{}, nil
+	case CodecNameNewline:
+		return NewlineObjectCodec{}, nil
+	case CodecNameContentLength:
+		return jsonrpc2.VSCodeObjectCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec name: %s", name)
+	}
+}
@@ -0,0 +1,196 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManySessions      = errors.New("too many sessions")
+	ErrTooManySessionsPerIP = errors.New("too many sessions from same address")
+	ErrAcceptRateLimited    = errors.New("connection rate limit exceeded")
+)
+
+// reasons of connection rejection, used as label for
+// MetricConnectionsRejected
+const (
+	rejectReasonMaxSessions      = "max_sessions"
+	rejectReasonMaxSessionsPerIP = "max_sessions_per_ip"
+	rejectReasonAcceptRate       = "accept_rate"
+	rejectReasonAcceptRatePerIP  = "accept_rate_per_ip"
+)
+
+// how often idle per-ip buckets are removed
+const acceptLimiterPruneInterval = time.Minute
+
+// remoteIP returns host part of remote_addr. empty string is returned for
+// addresses without host (like unix socket peers), such connections are
+// not limited per ip
+func remoteIP(remote_addr string) string {
+	host, _, err := net.SplitHostPort(remote_addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func rateLimitIsSet(limit RateLimit) bool {
+	return limit.Rate > 0 || limit.Burst > 0
+}
+
+type acceptLimiter struct {
+	global *tokenBucket
+
+	limit_per_ip RateLimit
+	per_ip       map[string]*tokenBucket
+	last_prune   time.Time
+
+	mutex *sync.Mutex
+}
+
+// returns nil if no limits are set. limits with zero Rate are rejected:
+// per-ip buckets of such limits would never be refilled, so they couldn't
+// be pruned
+func newAcceptLimiter(global RateLimit, per_ip RateLimit) (*acceptLimiter, error) {
+	if rateLimitIsSet(global) && global.Rate <= 0 {
+		return nil, errors.New("AcceptRateLimit.Rate must be positive")
+	}
+
+	if rateLimitIsSet(per_ip) && per_ip.Rate <= 0 {
+		return nil, errors.New("AcceptRateLimitPerIP.Rate must be positive")
+	}
+
+	if !rateLimitIsSet(global) && !rateLimitIsSet(per_ip) {
+		return nil, nil
+	}
+
+	self := &acceptLimiter{
+		limit_per_ip: per_ip,
+		per_ip:       make(map[string]*tokenBucket),
+		last_prune:   time.Now(),
+		mutex:        &sync.Mutex{},
+	}
+
+	if rateLimitIsSet(global) {
+		self.global = newTokenBucket(global)
+	}
+
+	return self, nil
+}
+
+// returns rejection reason or empty string. can be called on nil
+// *acceptLimiter
+func (self *acceptLimiter) allow(ip string) string {
+	if self == nil {
+		return ""
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(self.last_prune) >= acceptLimiterPruneInterval {
+		self.prune(now)
+	}
+
+	var bucket *tokenBucket
+
+	if ip != "" && rateLimitIsSet(self.limit_per_ip) {
+		var ok bool
+		bucket, ok = self.per_ip[ip]
+		if !ok {
+			bucket = newTokenBucket(self.limit_per_ip)
+			self.per_ip[ip] = bucket
+		}
+	}
+
+	// per-ip bucket is checked first, so clients exceeding own limit don't
+	// consume tokens of global one
+	if bucket != nil && !bucket.take(now) {
+		return rejectReasonAcceptRatePerIP
+	}
+
+	if self.global != nil && !self.global.take(now) {
+		return rejectReasonAcceptRate
+	}
+
+	return ""
+}
+
+// removes buckets which are refilled completely, as they are same as new
+// ones. must be called with mutex locked
+func (self *acceptLimiter) prune(now time.Time) {
+	self.last_prune = now
+
+	for k, v := range self.per_ip {
+		refilled := v.tokens + now.Sub(v.last).Seconds()*v.rate
+		if refilled >= v.burst {
+			delete(self.per_ip, k)
+		}
+	}
+}
+
+func (self *Server) countRejectedConnection(reason string) {
+	self.options.Metrics.CounterAdd(
+		MetricConnectionsRejected,
+		"number of connections rejected by limits",
+		1,
+		"reason", reason,
+	)
+}
+
+// checkAcceptRate is called for each new connection before anything else
+// is done with it
+func (self *Server) checkAcceptRate(remote_addr string) error {
+	reason := self.accept_limiter.allow(remoteIP(remote_addr))
+	if reason == "" {
+		return nil
+	}
+
+	self.countRejectedConnection(reason)
+
+	return ErrAcceptRateLimited
+}
+
+// must be called with sessions_mutex locked (read lock is enough)
+func (self *Server) checkSessionLimitsLocked(ip string) string {
+	if self.options.MaxSessions > 0 &&
+		len(self.sessions) >= self.options.MaxSessions {
+		return rejectReasonMaxSessions
+	}
+
+	if self.options.MaxSessionsPerIP > 0 && ip != "" &&
+		self.sessions_per_ip[ip] >= self.options.MaxSessionsPerIP {
+		return rejectReasonMaxSessionsPerIP
+	}
+
+	return ""
+}
+
+// checkSessionLimits allows to reject connection early (before TLS
+// handshake or WebSocket upgrade). registerSession() checks limits again,
+// so result is not guaranteed
+func (self *Server) checkSessionLimits(remote_addr string) error {
+	self.sessions_mutex.RLock()
+	reason := self.checkSessionLimitsLocked(remoteIP(remote_addr))
+	self.sessions_mutex.RUnlock()
+
+	return self.sessionLimitError(reason)
+}
+
+// counts rejection and converts reason to error. nil for empty reason
+func (self *Server) sessionLimitError(reason string) error {
+	switch reason {
+	case "":
+		return nil
+	case rejectReasonMaxSessionsPerIP:
+		self.countRejectedConnection(reason)
+		return ErrTooManySessionsPerIP
+	default:
+		self.countRejectedConnection(reason)
+		return ErrTooManySessions
+	}
+}
@@ -0,0 +1,192 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAcceptLimiterReasons(t *testing.T) {
+
+	limiter, err := newAcceptLimiter(
+		RateLimit{Rate: 1, Burst: 3},
+		RateLimit{Rate: 1, Burst: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 2; i++ {
+		reason := limiter.allow("10.0.0.1")
+		if reason != "" {
+			t.Fatal("connection", i, "is rejected:", reason)
+		}
+	}
+
+	reason := limiter.allow("10.0.0.1")
+	if reason != rejectReasonAcceptRatePerIP {
+		t.Fatal("unexpected reason:", reason)
+	}
+
+	// per-ip rejection doesn't consume global tokens
+	reason = limiter.allow("10.0.0.2")
+	if reason != "" {
+		t.Fatal("connection from other address is rejected:", reason)
+	}
+
+	reason = limiter.allow("10.0.0.3")
+	if reason != rejectReasonAcceptRate {
+		t.Fatal("unexpected reason:", reason)
+	}
+}
+
+func TestAcceptLimiterPrune(t *testing.T) {
+
+	limiter, err := newAcceptLimiter(RateLimit{}, RateLimit{Rate: 10, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter.allow("10.0.0.1")
+	limiter.allow("10.0.0.2")
+
+	limiter.mutex.Lock()
+	limiter.prune(time.Now())
+	if len(limiter.per_ip) != 2 {
+		t.Fatal("buckets which aren't refilled are pruned")
+	}
+	limiter.prune(time.Now().Add(time.Second))
+	if len(limiter.per_ip) != 0 {
+		t.Fatal("refilled buckets aren't pruned")
+	}
+	limiter.mutex.Unlock()
+}
+
+func TestAcceptLimiterRejectsZeroRate(t *testing.T) {
+
+	_, err := newAcceptLimiter(RateLimit{}, RateLimit{Burst: 10})
+	if err == nil {
+		t.Fatal("per-ip limit without rate is accepted")
+	}
+
+	_, err = newAcceptLimiter(RateLimit{Burst: 10}, RateLimit{})
+	if err == nil {
+		t.Fatal("global limit without rate is accepted")
+	}
+
+	limiter, err := newAcceptLimiter(RateLimit{}, RateLimit{})
+	if err != nil || limiter != nil {
+		t.Fatal("empty limits must give nil limiter:", limiter, err)
+	}
+}
+
+func TestAcceptRateLimitsHTTPPost(t *testing.T) {
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			AcceptRateLimitPerIP: RateLimit{Rate: 0.001, Burst: 2},
+		},
+		nil,
+	)
+
+	for i := 0; i != 2; i++ {
+		code, _ := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+		if code != http.StatusOK {
+			t.Fatal("request", i, "is rejected:", code)
+		}
+	}
+
+	code, _ := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("request over limit isn't rejected:", code)
+	}
+}
+
+func TestAcceptRateIsCheckedBeforeAuthentication(t *testing.T) {
+
+	var authenticated int32
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			AcceptRateLimitPerIP: RateLimit{Rate: 0.001, Burst: 2},
+			HTTPAuthenticator: func(r *http.Request) (interface{}, error) {
+				atomic.AddInt32(&authenticated, 1)
+				return nil, errors.New("wrong credentials")
+			},
+		},
+		nil,
+	)
+
+	// rejected requests consume tokens too
+	for i := 0; i != 2; i++ {
+		code, _ := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+		if code != http.StatusUnauthorized {
+			t.Fatal("unexpected status:", code)
+		}
+	}
+
+	code, _ := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusServiceUnavailable {
+		t.Fatal("request over limit isn't rejected:", code)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+address+DefaultWSPath, nil)
+	if err == nil {
+		t.Fatal("connection over limit is accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("unexpected response:", resp, err)
+	}
+
+	if x := atomic.LoadInt32(&authenticated); x != 2 {
+		t.Fatal("requests over limit are authenticated:", x)
+	}
+}
+
+func TestMaxSessionsPerIP(t *testing.T) {
+
+	server, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			MaxSessionsPerIP: 1,
+		},
+		nil,
+	)
+
+	url := "ws://" + address + DefaultWSPath
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("second session from same address is accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("unexpected response:", resp, err)
+	}
+
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SessionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session isn't destroyed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("session is rejected after previous one is closed:", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,71 @@
+package gojsonrpc2server
+
+import (
+	"encoding/json"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// Error codes defined by JSON-RPC 2.0 specification
+const (
+	CodeParseError     int64 = jsonrpc2.CodeParseError
+	CodeInvalidRequest int64 = jsonrpc2.CodeInvalidRequest
+	CodeMethodNotFound int64 = jsonrpc2.CodeMethodNotFound
+	CodeInvalidParams  int64 = jsonrpc2.CodeInvalidParams
+	CodeInternalError  int64 = jsonrpc2.CodeInternalError
+)
+
+// Implementation defined server error codes (-32000 to -32099 range is
+// reserved for them by specification)
+const (
+	CodeServerShuttingDown int64 = -32000
+	CodeUnauthorized       int64 = -32001
+	CodeRateLimited        int64 = -32002
+)
+
+// NewError creates error object. data can be nil - so `data` field of error
+// will be null. If data can't be marshaled, it's error text used as data.
+func NewError(code int64, message string, data interface{}) *jsonrpc2.Error {
+	ret := &jsonrpc2.Error{
+		Code:    code,
+		Message: message,
+	}
+
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			b, _ = json.Marshal(err.Error())
+		}
+		ret.Data = (*json.RawMessage)(&b)
+	}
+
+	return ret
+}
+
+func ErrParseError(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeParseError, "Parse error", data)
+}
+
+func ErrInvalidRequest(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeInvalidRequest, "Invalid Request", data)
+}
+
+func ErrMethodNotFound(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeMethodNotFound, "Method not found", data)
+}
+
+func ErrInvalidParams(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeInvalidParams, "Invalid params", data)
+}
+
+func ErrInternalError(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeInternalError, "Internal error", data)
+}
+
+func ErrUnauthorized(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeUnauthorized, "Unauthorized", data)
+}
+
+func ErrRateLimited(data interface{}) *jsonrpc2.Error {
+	return NewError(CodeRateLimited, "Rate limit exceeded", data)
+}
@@ -15,42 +15,63 @@ type HandleResponder struct {
 
 	uuid string
 
-	log       func(txt ...interface{})
+	loggerHolder
+
 	responded bool
+	// code of error reply. 0 if success reply is sent or nothing is sent
+	error_code int64
 }
 
+// log is used same way as LogFunc
 func NewHandleResponder(
 	ctx context.Context,
 	conn *jsonrpc2.Conn,
 	req *jsonrpc2.Request,
 	uuid string,
 	log func(txt ...interface{}),
+) *HandleResponder {
+	return NewHandleResponderWithLogger(ctx, conn, req, uuid, LogFunc(log))
+}
+
+// records are passed to logger with call id and method fields added
+func NewHandleResponderWithLogger(
+	ctx context.Context,
+	conn *jsonrpc2.Conn,
+	req *jsonrpc2.Request,
+	uuid string,
+	logger Logger,
 ) *HandleResponder {
 	self := &HandleResponder{
 		ctx:  ctx,
 		conn: conn,
 		req:  req,
 		uuid: uuid,
-		log:  log,
 	}
 
+	self.logger = WithFields(
+		logger,
+		LogFieldCallID, uuid,
+		LogFieldMethod, req.Method,
+	)
+
 	return self
 }
 
 // call this with defer
 func (self *HandleResponder) Defer() error {
+	if self.req.Notif {
+		return nil
+	}
 	if !self.responded {
-		self.Log("error: this is default error if handler didn't responded")
-		return self.RespError(500, "internal error")
+		self.LogError("this is default error if handler didn't responded")
+		return self.ReplyWithError(ErrInternalError("handler didn't respond"))
 	}
 	return nil
 }
 
-// Format message and send it using log()
-func (self *HandleResponder) Log(txt ...interface{}) {
-	t := []interface{}{fmt.Sprintf("[call %s]", self.uuid)}
-	t = append(t, txt...)
-	self.log(t...)
+// Returns true if reply (success or error) was sent
+func (self *HandleResponder) Responded() bool {
+	return self.responded
 }
 
 // Format text, make error message and use ReplyWithError() function
@@ -64,14 +85,26 @@ func (self *HandleResponder) RespError(code int64, txt ...interface{}) error {
 	return ret
 }
 
-// Format message, log it with log() and send copy as error reply to rpc
+// Format text, make error message with data and use ReplyWithError() function
+func (self *HandleResponder) RespErrorWithData(code int64, data interface{}, txt ...interface{}) error {
+	ret := self.ReplyWithError(
+		NewError(
+			code,
+			strings.TrimRight(fmt.Sprintln(txt...), "\n"),
+			data,
+		),
+	)
+	return ret
+}
+
+// Format message, log it with LogError() and send copy as error reply to rpc
 func (self *HandleResponder) LogRespError(code int64, txt ...interface{}) error {
 	e := &jsonrpc2.Error{
 		Code:    code,
 		Message: strings.TrimRight(fmt.Sprintln(txt...), "\n"),
 	}
-	self.Log(e.Error())
-	return self.RespError(code, e.Error())
+	self.LogError(e.Error())
+	return self.ReplyWithError(e)
 }
 
 // Send success reply to rpc
@@ -93,5 +126,6 @@ func (self *HandleResponder) ReplyWithError(respErr *jsonrpc2.Error) error {
 		respErr,
 	)
 	self.responded = true
+	self.error_code = respErr.Code
 	return ret
 }
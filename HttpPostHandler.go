@@ -0,0 +1,320 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+const (
+	DefaultHTTPPostPath        = "/rpc"
+	DefaultHTTPPostMaxBodySize = 1 << 20
+	DefaultHTTPPostTimeout     = 10 * time.Second
+)
+
+// httpObjectStream is used to pass already received requests to
+// jsonrpc2.Conn and to collect responses written by it
+type httpObjectStream struct {
+	requests  []json.RawMessage
+	responses []json.RawMessage
+	expected  int
+
+	exhausted bool
+
+	done       chan struct{}
+	done_guard *sync.Once
+
+	closed       chan struct{}
+	closed_guard *sync.Once
+
+	mutex *sync.Mutex
+}
+
+var _ jsonrpc2.ObjectStream = &httpObjectStream{}
+
+func newHttpObjectStream(requests []json.RawMessage, expected int) *httpObjectStream {
+	self := &httpObjectStream{
+		requests:     requests,
+		expected:     expected,
+		done:         make(chan struct{}),
+		done_guard:   &sync.Once{},
+		closed:       make(chan struct{}),
+		closed_guard: &sync.Once{},
+		mutex:        &sync.Mutex{},
+	}
+	return self
+}
+
+// must be called with mutex locked
+func (self *httpObjectStream) checkDone() {
+	if self.exhausted && len(self.responses) >= self.expected {
+		self.done_guard.Do(func() { close(self.done) })
+	}
+}
+
+func (self *httpObjectStream) ReadObject(v interface{}) error {
+	self.mutex.Lock()
+	if len(self.requests) != 0 {
+		req := self.requests[0]
+		self.requests = self.requests[1:]
+		self.mutex.Unlock()
+		return json.Unmarshal(req, v)
+	}
+	// requests are handled synchronously, so all of them are handled
+	// at this point
+	self.exhausted = true
+	self.checkDone()
+	self.mutex.Unlock()
+
+	<-self.closed
+	return io.EOF
+}
+
+func (self *httpObjectStream) WriteObject(obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	var probe struct {
+		Method *string `json:"method"`
+	}
+
+	err = json.Unmarshal(data, &probe)
+	if err != nil {
+		return err
+	}
+
+	if probe.Method != nil {
+		// http client can't receive server initiated requests
+		return nil
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.responses = append(self.responses, json.RawMessage(data))
+	self.checkDone()
+
+	return nil
+}
+
+func (self *httpObjectStream) Close() error {
+	self.closed_guard.Do(func() { close(self.closed) })
+	return nil
+}
+
+func (self *httpObjectStream) Done() <-chan struct{} {
+	return self.done
+}
+
+func (self *httpObjectStream) Responses() []json.RawMessage {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ret := make([]json.RawMessage, len(self.responses))
+	copy(ret, self.responses)
+	return ret
+}
+
+func (self *Server) httpPostTimeout() time.Duration {
+	if self.options.HTTPPostTimeout == 0 {
+		return DefaultHTTPPostTimeout
+	}
+	return self.options.HTTPPostTimeout
+}
+
+// HttpPostHandler serves JSON-RPC requests (single or batch) received with
+// plain HTTP POST. Short-lived Session is created for each HTTP request
+type HttpPostHandler struct {
+	server *Server
+}
+
+func (self *HttpPostHandler) errorResponse(err *jsonrpc2.Error) json.RawMessage {
+	ret, _ := json.Marshal(
+		map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      nil,
+			"error":   err,
+		},
+	)
+	return json.RawMessage(ret)
+}
+
+func (self *HttpPostHandler) writeResponse(
+	w http.ResponseWriter,
+	batch bool,
+	responses []json.RawMessage,
+) {
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var data []byte
+	var err error
+
+	if batch {
+		data, err = json.Marshal(responses)
+	} else {
+		data, err = json.Marshal(responses[0])
+	}
+	if err != nil {
+		self.server.LogError("http post: can't marshal response:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (self *HttpPostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// each request gets own session, so it's limited as new connection
+	err := self.server.checkAcceptRate(r.RemoteAddr)
+	if err != nil {
+		self.server.LogError("http post: rejecting request from", r.RemoteAddr, ":", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	principal, authenticated, ok := self.server.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	max_body_size := self.server.options.HTTPPostMaxBodySize
+	if max_body_size == 0 {
+		max_body_size = DefaultHTTPPostMaxBodySize
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max_body_size))
+	if err != nil {
+		self.server.LogError("http post: can't read request body:", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+
+	batch := len(body) != 0 && body[0] == '['
+
+	var items []json.RawMessage
+
+	if batch {
+		err = json.Unmarshal(body, &items)
+		if err != nil {
+			self.writeResponse(
+				w,
+				false,
+				[]json.RawMessage{self.errorResponse(ErrParseError(err.Error()))},
+			)
+			return
+		}
+
+		if len(items) == 0 {
+			self.writeResponse(
+				w,
+				false,
+				[]json.RawMessage{self.errorResponse(ErrInvalidRequest("empty batch"))},
+			)
+			return
+		}
+	} else {
+		if !json.Valid(body) {
+			self.writeResponse(
+				w,
+				false,
+				[]json.RawMessage{self.errorResponse(ErrParseError(nil))},
+			)
+			return
+		}
+		items = []json.RawMessage{json.RawMessage(body)}
+	}
+
+	var responses []json.RawMessage
+	var requests []json.RawMessage
+	var expected int
+
+	for _, i := range items {
+		var req jsonrpc2.Request
+		err = json.Unmarshal(i, &req)
+		if err != nil || req.Method == "" {
+			responses = append(responses, self.errorResponse(ErrInvalidRequest(nil)))
+			continue
+		}
+
+		requests = append(requests, i)
+		if !req.Notif {
+			expected++
+		}
+	}
+
+	if len(requests) != 0 {
+		session_id := uuid.NewV4().String()
+
+		newsession, err := NewSession(
+			&SessionOptions{
+				Server:     self.server,
+				SessionID:  session_id,
+				RemoteAddr: r.RemoteAddr,
+				Transport:  TransportHTTP,
+
+				TLSConnectionState: r.TLS,
+
+				Principal:     principal,
+				Authenticated: authenticated,
+			},
+		)
+		if err != nil {
+			self.server.LogError("http post: error creating session:", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		stream := newHttpObjectStream(requests, expected)
+
+		go newsession.HandleBS(stream)
+
+		timer := time.NewTimer(self.server.httpPostTimeout())
+
+		select {
+		case <-stream.Done():
+		case <-timer.C:
+			newsession.LogError("http post: timeout waiting for responses")
+		case <-r.Context().Done():
+			newsession.Log("http post: client gone")
+		}
+
+		timer.Stop()
+
+		newsession.Destroy()
+		stream.Close()
+
+		responses = append(responses, stream.Responses()...)
+
+		if !batch && len(responses) == 0 && expected != 0 {
+			responses = append(
+				responses,
+				self.errorResponse(ErrInternalError("no response")),
+			)
+		}
+	}
+
+	self.writeResponse(w, batch, responses)
+}
@@ -0,0 +1,127 @@
+package gojsonrpc2server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpPostSingleAndBatch(t *testing.T) {
+
+	_, address := testStartHTTPServer(t, nil, nil)
+
+	code, body := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusOK || !strings.Contains(body, `"id":1,"result":1`) {
+		t.Fatal("unexpected response:", code, body)
+	}
+
+	code, body = testPost(
+		t,
+		address,
+		`[{"jsonrpc":"2.0","id":1,"method":"a"},`+
+			`{"jsonrpc":"2.0","method":"notification"},`+
+			`{"jsonrpc":"2.0","id":2}]`,
+	)
+	if code != http.StatusOK {
+		t.Fatal("unexpected status:", code)
+	}
+	if !strings.HasPrefix(body, "[") ||
+		!strings.Contains(body, `"id":1,"result":1`) ||
+		!strings.Contains(body, `"code":-32600`) ||
+		strings.Count(body, `"jsonrpc"`) != 2 {
+		t.Fatal("unexpected batch response:", body)
+	}
+
+	code, body = testPost(t, address, `{"jsonrpc":"2.0","method":"notification"}`)
+	if code != http.StatusNoContent || body != "" {
+		t.Fatal("unexpected response to notification:", code, body)
+	}
+
+	code, body = testPost(t, address, `{"jsonrpc":`)
+	if !strings.Contains(body, `"code":-32700`) {
+		t.Fatal("expected parse error, got:", code, body)
+	}
+
+	resp, err := http.Get("http://" + address + DefaultHTTPPostPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status for GET:", resp.StatusCode)
+	}
+}
+
+func TestHttpPostSessionRejectsServerInitiatedMessages(t *testing.T) {
+
+	errs := make(chan error, 2)
+
+	_, address := testStartHTTPServer(
+		t,
+		nil,
+		func(ctx *RPCHandleContext) {
+			errs <- ctx.Session.Notify(context.Background(), "n", nil)
+			errs <- ctx.Session.Call(context.Background(), "c", nil, nil)
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	code, body := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusOK || !strings.Contains(body, `"result":1`) {
+		t.Fatal("unexpected response:", code, body)
+	}
+
+	for i := 0; i != 2; i++ {
+		err := <-errs
+		if err != ErrSessionTransportUnsupported {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+}
+
+func TestHttpPostTimeout(t *testing.T) {
+
+	release := make(chan struct{})
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			HTTPPostTimeout:      200 * time.Millisecond,
+			AsyncRequestHandling: true,
+		},
+		func(ctx *RPCHandleContext) {
+			<-release
+		},
+	)
+
+	t.Cleanup(func() { close(release) })
+
+	code, body := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if code != http.StatusOK ||
+		!strings.Contains(body, `"code":-32603`) ||
+		!strings.Contains(body, "no response") {
+		t.Fatal("unexpected response:", code, body)
+	}
+}
+
+func TestHttpPostWriteTimeoutIsLongerThanHTTPPostTimeout(t *testing.T) {
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+
+		server, _ := testStartHTTPServer(
+			t,
+			&ServerOptions{HTTPPostTimeout: timeout},
+			nil,
+		)
+
+		server.listeners_mutex.Lock()
+		for _, i := range server.http_servers {
+			if i.WriteTimeout <= server.httpPostTimeout() {
+				t.Fatal("write timeout isn't longer than HTTPPostTimeout:", i.WriteTimeout)
+			}
+		}
+		server.listeners_mutex.Unlock()
+	}
+}
@@ -0,0 +1,121 @@
+package gojsonrpc2server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DefaultWSPingWriteTimeout = 10 * time.Second
+
+// setTCPKeepAlive applies TCPKeepAlivePeriod to accepted connection.
+// connections other than *net.TCPConn (unix sockets) are left as is
+func (self *Server) setTCPKeepAlive(conn net.Conn) {
+
+	period := self.options.TCPKeepAlivePeriod
+	if period == 0 {
+		return
+	}
+
+	tcp_conn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if period < 0 {
+		tcp_conn.SetKeepAlive(false)
+		return
+	}
+
+	tcp_conn.SetKeepAlive(true)
+	tcp_conn.SetKeepAlivePeriod(period)
+}
+
+// startWSKeepAlive pings client every WSPingInterval. connection is closed
+// (and session is destroyed) if no pong is received in
+// WSPingInterval + WSPongTimeout
+func (self *Session) startWSKeepAlive(conn *websocket.Conn) {
+
+	interval := self.options.Server.options.WSPingInterval
+	if interval <= 0 {
+		return
+	}
+
+	pong_timeout := self.options.Server.options.WSPongTimeout
+	if pong_timeout <= 0 {
+		pong_timeout = interval
+	}
+
+	conn.SetReadDeadline(time.Now().Add(interval + pong_timeout))
+	conn.SetPongHandler(
+		func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(interval + pong_timeout))
+		},
+	)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-self.destroyed_chan:
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(
+					websocket.PingMessage,
+					nil,
+					time.Now().Add(DefaultWSPingWriteTimeout),
+				)
+				if err != nil {
+					self.LogDebug("websocket ping error:", err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (self *Session) touchActivity() {
+	atomic.StoreInt64(&self.last_activity, time.Now().UnixNano())
+}
+
+// must be called with jsonrpc2_conn_mutex locked
+func (self *Session) startIdleTimer() {
+
+	timeout := self.options.Server.options.SessionIdleTimeout
+
+	self.touchActivity()
+
+	var check func()
+	check = func() {
+		select {
+		case <-self.destroyed_chan:
+			return
+		default:
+		}
+
+		// requests being handled count as activity
+		if atomic.LoadInt64(&self.in_flight) > 0 {
+			self.touchActivity()
+		}
+
+		last := time.Unix(0, atomic.LoadInt64(&self.last_activity))
+		idle := time.Since(last)
+		if idle >= timeout {
+			self.Log("idle timeout")
+			self.Destroy()
+			return
+		}
+
+		self.jsonrpc2_conn_mutex.Lock()
+		if !self.destroyed {
+			self.idle_timer = time.AfterFunc(timeout-idle, check)
+		}
+		self.jsonrpc2_conn_mutex.Unlock()
+	}
+
+	self.idle_timer = time.AfterFunc(timeout, check)
+}
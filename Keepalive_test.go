@@ -0,0 +1,57 @@
+package gojsonrpc2server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIdleTimeoutWaitsForInFlightRequests(t *testing.T) {
+
+	server, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			SessionIdleTimeout: 200 * time.Millisecond,
+		},
+		func(ctx *RPCHandleContext) {
+			time.Sleep(600 * time.Millisecond)
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+DefaultWSPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var resp struct {
+		Result int
+	}
+	err = conn.ReadJSON(&resp)
+	if err != nil {
+		t.Fatal("session is closed while handling request:", err)
+	}
+	if resp.Result != 1 {
+		t.Fatal("unexpected response:", resp)
+	}
+
+	// idle timeout is counted from end of request handling
+	time.Sleep(100 * time.Millisecond)
+	if server.SessionCount() != 1 {
+		t.Fatal("session is closed right after request is handled")
+	}
+
+	_, _, err = conn.ReadMessage()
+	if err == nil {
+		t.Fatal("idle session isn't closed")
+	}
+}
@@ -0,0 +1,175 @@
+package gojsonrpc2server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (self LogLevel) String() string {
+	switch self {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(self))
+	}
+}
+
+// keys of fields, passed to Logger by this package
+const (
+	LogFieldComponent  = "component"
+	LogFieldSessionID  = "session_id"
+	LogFieldCallID     = "call_id"
+	LogFieldMethod     = "method"
+	LogFieldRemoteAddr = "remote_addr"
+	LogFieldTransport  = "transport"
+	LogFieldDescriptor = "descriptor"
+)
+
+// Logger receives log records. fields are key-value pairs, same way as
+// in log/slog: string key followed by any value
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...interface{})
+}
+
+// WithFields returns Logger which adds fields to each record passed to
+// logger
+func WithFields(logger Logger, fields ...interface{}) Logger {
+	if len(fields) == 0 {
+		return logger
+	}
+
+	if x, ok := logger.(*fieldsLogger); ok {
+		t := make([]interface{}, 0, len(x.fields)+len(fields))
+		t = append(t, x.fields...)
+		t = append(t, fields...)
+		return &fieldsLogger{logger: x.logger, fields: t}
+	}
+
+	return &fieldsLogger{logger: logger, fields: fields}
+}
+
+type fieldsLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+func (self *fieldsLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	t := make([]interface{}, 0, len(self.fields)+len(fields))
+	t = append(t, self.fields...)
+	t = append(t, fields...)
+	self.logger.Log(level, msg, t...)
+}
+
+// StdLogger writes records using standard log package as text lines like
+//
+//	[INFO] message key=value key2="value with spaces"
+type StdLogger struct {
+	Logger   *log.Logger
+	MinLevel LogLevel
+}
+
+var _ Logger = &StdLogger{}
+
+// if logger is nil, new one writing to stderr is used
+func NewStdLogger(logger *log.Logger, min_level LogLevel) *StdLogger {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	self := &StdLogger{
+		Logger:   logger,
+		MinLevel: min_level,
+	}
+	return self
+}
+
+func (self *StdLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if level < self.MinLevel {
+		return
+	}
+
+	self.Logger.Println(formatLogRecord(level, msg, fields...))
+}
+
+// LogFunc allows to use functions like log.Println as Logger. records
+// are formatted same way as StdLogger does
+type LogFunc func(txt ...interface{})
+
+var _ Logger = LogFunc(nil)
+
+func (self LogFunc) Log(level LogLevel, msg string, fields ...interface{}) {
+	self(formatLogRecord(level, msg, fields...))
+}
+
+func formatLogRecord(level LogLevel, msg string, fields ...interface{}) string {
+	b := &strings.Builder{}
+
+	b.WriteString("[")
+	b.WriteString(level.String())
+	b.WriteString("] ")
+	b.WriteString(msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteString(" ")
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteString("=")
+		if i+1 < len(fields) {
+			v := fmt.Sprint(fields[i+1])
+			if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			b.WriteString(v)
+		}
+	}
+
+	return b.String()
+}
+
+// used by Log* functions of loggerHolder to make message from their
+// arguments
+func logMessage(txt ...interface{}) string {
+	return strings.TrimRight(fmt.Sprintln(txt...), "\n")
+}
+
+// loggerHolder is embedded into Server, Session, SubscriptionMgr and
+// HandleResponder to give them Log* functions. all of them format their
+// arguments same way as fmt.Sprintln does
+type loggerHolder struct {
+	logger Logger
+}
+
+func (self *loggerHolder) GetLogger() Logger {
+	return self.logger
+}
+
+// Format message and log it with info level
+func (self *loggerHolder) Log(txt ...interface{}) {
+	self.logger.Log(LogLevelInfo, logMessage(txt...))
+}
+
+// Format message and log it with debug level
+func (self *loggerHolder) LogDebug(txt ...interface{}) {
+	self.logger.Log(LogLevelDebug, logMessage(txt...))
+}
+
+// Format message and log it with error level
+func (self *loggerHolder) LogError(txt ...interface{}) {
+	self.logger.Log(LogLevelError, logMessage(txt...))
+}
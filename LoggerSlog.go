@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package gojsonrpc2server
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger passes records to *slog.Logger
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+var _ Logger = &SlogLogger{}
+
+// if logger is nil, slog.Default() is used
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	self := &SlogLogger{
+		Logger: logger,
+	}
+	return self
+}
+
+func (self *SlogLogger) Log(level LogLevel, msg string, fields ...interface{}) {
+	var slog_level slog.Level
+
+	switch level {
+	case LogLevelDebug:
+		slog_level = slog.LevelDebug
+	case LogLevelInfo:
+		slog_level = slog.LevelInfo
+	case LogLevelWarn:
+		slog_level = slog.LevelWarn
+	default:
+		slog_level = slog.LevelError
+	}
+
+	self.Logger.Log(context.Background(), slog_level, msg, fields...)
+}
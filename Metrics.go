@@ -0,0 +1,372 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultMetricsPath               = "/metrics"
+	DefaultMetricsMaxSeriesPerMetric = 1000
+)
+
+// names of metrics, recorded by this package (without namespace)
+const (
+	MetricSessionsActive             = "sessions_active"
+	MetricSessionsTotal              = "sessions_total"
+	MetricRequestsTotal              = "requests_total"
+	MetricResponsesTotal             = "responses_total"
+	MetricRequestDuration            = "request_duration_seconds"
+	MetricPanicsTotal                = "panics_total"
+	MetricRequestsRejected           = "requests_rejected_total"
+	MetricConnectionsRejected        = "connections_rejected_total"
+	MetricSubscriptionMgrDescriptors = "subscriptionmgr_descriptors"
+	MetricSubscriptionMgrSubscribers = "subscriptionmgr_subscribers"
+
+	MetricSubscriptionMgrDispatchQueued  = "subscriptionmgr_dispatch_queued"
+	MetricSubscriptionMgrDispatchDropped = "subscriptionmgr_dispatch_dropped_total"
+	MetricSubscriptionMgrSlowSubscribers = "subscriptionmgr_slow_subscribers_total"
+	MetricSubscriptionMgrReconnects      = "subscriptionmgr_reconnects_total"
+	MetricSubscriptionMgrConnections     = "subscriptionmgr_connections"
+)
+
+// value of "method" label for methods unknown to AppContextSession
+const MetricMethodOther = "other"
+
+// implemented by AppContextSession implementations (see Router) which can
+// tell if method is known to them. used to keep "method" label of metrics
+// bounded
+type methodChecker interface {
+	HasMethod(method string) bool
+}
+
+var DefaultDurationBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+const (
+	metricTypeCounter   = "counter"
+	metricTypeGauge     = "gauge"
+	metricTypeHistogram = "histogram"
+)
+
+type metricSeries struct {
+	labels string
+
+	value float64
+
+	bucket_counts []uint64
+	sum           float64
+	count         uint64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+
+	series map[string]*metricSeries
+}
+
+// Metrics is simple registry of counters, gauges and histograms, which
+// can be exposed in Prometheus text format. It's designed to be passed
+// to ServerOptions and SubscriptionMgrOptions, but application can record
+// it's own values too.
+//
+// All methods can be called on nil *Metrics - they do nothing in this case.
+//
+// labels are passed as key-value pairs. Metric is defined on first use,
+// so same name must always be used with same type and labels
+type Metrics struct {
+	namespace string
+
+	// new label combinations over this number are not recorded. this
+	// prevents unbounded growth if, for instance, clients call many
+	// unexisting methods
+	MaxSeriesPerMetric int
+
+	families map[string]*metricFamily
+	mutex    *sync.Mutex
+}
+
+// namespace is prefixed to all names with "_" separator. can be empty
+func NewMetrics(namespace string) *Metrics {
+	self := &Metrics{
+		namespace:          namespace,
+		MaxSeriesPerMetric: DefaultMetricsMaxSeriesPerMetric,
+		families:           make(map[string]*metricFamily),
+		mutex:              &sync.Mutex{},
+	}
+	return self
+}
+
+func (self *Metrics) fullName(name string) string {
+	if self.namespace == "" {
+		return name
+	}
+	return self.namespace + "_" + name
+}
+
+func escapeMetricLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return value
+}
+
+func formatMetricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	b := &strings.Builder{}
+	for i := 0; i < len(labels); i += 2 {
+		if i != 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		if i+1 < len(labels) {
+			b.WriteString(escapeMetricLabelValue(labels[i+1]))
+		}
+		b.WriteString(`"`)
+	}
+	return b.String()
+}
+
+// must be called with mutex locked. returns nil if series limit reached
+func (self *Metrics) getSeries(
+	name string,
+	help string,
+	typ string,
+	buckets []float64,
+	labels []string,
+) *metricSeries {
+
+	full_name := self.fullName(name)
+
+	family, ok := self.families[full_name]
+	if !ok {
+		family = &metricFamily{
+			name:    full_name,
+			help:    help,
+			typ:     typ,
+			buckets: buckets,
+			series:  make(map[string]*metricSeries),
+		}
+		self.families[full_name] = family
+	}
+
+	labels_str := formatMetricLabels(labels)
+
+	series, ok := family.series[labels_str]
+	if !ok {
+		if self.MaxSeriesPerMetric > 0 &&
+			len(family.series) >= self.MaxSeriesPerMetric {
+			return nil
+		}
+
+		series = &metricSeries{labels: labels_str}
+		if typ == metricTypeHistogram {
+			series.bucket_counts = make([]uint64, len(family.buckets))
+		}
+		family.series[labels_str] = series
+	}
+
+	return series
+}
+
+func (self *Metrics) CounterAdd(name string, help string, value float64, labels ...string) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	series := self.getSeries(name, help, metricTypeCounter, nil, labels)
+	if series == nil {
+		return
+	}
+	series.value += value
+}
+
+func (self *Metrics) GaugeAdd(name string, help string, value float64, labels ...string) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	series := self.getSeries(name, help, metricTypeGauge, nil, labels)
+	if series == nil {
+		return
+	}
+	series.value += value
+}
+
+func (self *Metrics) GaugeSet(name string, help string, value float64, labels ...string) {
+	if self == nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	series := self.getSeries(name, help, metricTypeGauge, nil, labels)
+	if series == nil {
+		return
+	}
+	series.value = value
+}
+
+// buckets are used only on first observation of metric. nil means
+// DefaultDurationBuckets
+func (self *Metrics) HistogramObserve(
+	name string,
+	help string,
+	buckets []float64,
+	value float64,
+	labels ...string,
+) {
+	if self == nil {
+		return
+	}
+
+	if buckets == nil {
+		buckets = DefaultDurationBuckets
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	series := self.getSeries(name, help, metricTypeHistogram, buckets, labels)
+	if series == nil {
+		return
+	}
+
+	family := self.families[self.fullName(name)]
+
+	for i, le := range family.buckets {
+		if value <= le {
+			series.bucket_counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func joinMetricLabels(a string, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return a + "," + b
+	}
+}
+
+func writeMetricLine(w io.Writer, name string, labels string, value float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+	} else {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatMetricValue(value))
+	}
+}
+
+// WritePrometheus writes all metrics in Prometheus text exposition format
+func (self *Metrics) WritePrometheus(w io.Writer) error {
+	if self == nil {
+		return nil
+	}
+
+	b := &bytes.Buffer{}
+
+	self.mutex.Lock()
+
+	names := make([]string, 0, len(self.families))
+	for k, _ := range self.families {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := self.families[name]
+
+		if family.help != "" {
+			help := strings.Replace(family.help, `\`, `\\`, -1)
+			help = strings.Replace(help, "\n", `\n`, -1)
+			fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, family.typ)
+
+		series_keys := make([]string, 0, len(family.series))
+		for k, _ := range family.series {
+			series_keys = append(series_keys, k)
+		}
+		sort.Strings(series_keys)
+
+		for _, k := range series_keys {
+			series := family.series[k]
+
+			if family.typ != metricTypeHistogram {
+				writeMetricLine(b, name, series.labels, series.value)
+				continue
+			}
+
+			for i, le := range family.buckets {
+				writeMetricLine(
+					b,
+					name+"_bucket",
+					joinMetricLabels(
+						series.labels,
+						`le="`+formatMetricValue(le)+`"`,
+					),
+					float64(series.bucket_counts[i]),
+				)
+			}
+			writeMetricLine(
+				b,
+				name+"_bucket",
+				joinMetricLabels(series.labels, `le="+Inf"`),
+				float64(series.count),
+			)
+			writeMetricLine(b, name+"_sum", series.labels, series.sum)
+			writeMetricLine(b, name+"_count", series.labels, float64(series.count))
+		}
+	}
+
+	self.mutex.Unlock()
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	self.WritePrometheus(w)
+}
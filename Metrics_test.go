@@ -0,0 +1,92 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type testRouterApp struct {
+	*Router
+}
+
+func (self *testRouterApp) Destroy() {
+}
+
+func TestMetricsUnknownMethodsAreNotLabeled(t *testing.T) {
+
+	router := NewRouter()
+	err := router.Register(
+		"known",
+		func(ctx *RPCHandleContext, params interface{}) (interface{}, error) {
+			return 1, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics("test")
+
+	_, address := testStartHTTPServerWithApp(
+		t,
+		&ServerOptions{Metrics: metrics},
+		&testRouterApp{router},
+	)
+
+	testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"known"}`)
+	testPost(t, address, `{"jsonrpc":"2.0","id":2,"method":"unknown-1"}`)
+	testPost(t, address, `{"jsonrpc":"2.0","id":3,"method":"unknown-2"}`)
+
+	b := &bytes.Buffer{}
+	err = metrics.WritePrometheus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	if strings.Contains(out, "unknown-") {
+		t.Fatal("unknown methods are used as label values:\n", out)
+	}
+
+	for _, i := range []string{
+		`test_requests_total{method="known",transport="http"} 1`,
+		`test_requests_total{method="other",transport="http"} 2`,
+	} {
+		if !strings.Contains(out, i) {
+			t.Fatal("metrics don't contain", i, ":\n", out)
+		}
+	}
+}
+
+func TestMetricsUnknownMethodsWithoutRouter(t *testing.T) {
+
+	metrics := NewMetrics("test")
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{Metrics: metrics},
+		func(ctx *RPCHandleContext) {
+			if ctx.Req.Method != "known" {
+				ctx.Responder.ReplyWithError(ErrMethodNotFound(nil))
+				return
+			}
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"known"}`)
+	testPost(t, address, `{"jsonrpc":"2.0","id":2,"method":"unknown-1"}`)
+
+	b := &bytes.Buffer{}
+	metrics.WritePrometheus(b)
+	out := b.String()
+
+	if strings.Contains(out, "unknown-") {
+		t.Fatal("unknown methods are used as label values:\n", out)
+	}
+
+	if !strings.Contains(out, `test_requests_total{method="known",transport="http"} 1`) {
+		t.Fatal("known method isn't counted:\n", out)
+	}
+}
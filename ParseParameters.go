@@ -18,18 +18,31 @@ func ParseParameters(
 
 	defer func() {
 		if x := recover(); x != nil {
-			responder.Log("run time panic while processing request: %v", x)
+			if responder != nil {
+				responder.LogError("run time panic while processing request:", x)
+			}
 			paniced = true
 		}
 	}()
 
-	// TODO: this can crush if params wasn't defined in request
+	if params == nil {
+		if responder != nil {
+			responder.Log("request have no parameters")
+			err := responder.ReplyWithError(ErrInvalidParams("params required"))
+			if err != nil {
+				responder.LogError("can't send error message to caller:", err)
+			}
+		}
+		return
+	}
+
 	data, err := params.MarshalJSON()
 	if err != nil {
 		if responder != nil {
-			err2 := responder.LogRespError(500, "error", "can't get input data for unmarshal")
-			if err != nil {
-				responder.Log("can't send error message to caller:", err2, "about:", err)
+			responder.Log("can't get input data for unmarshal:", err)
+			err2 := responder.ReplyWithError(ErrInvalidParams("can't get input data for unmarshal"))
+			if err2 != nil {
+				responder.LogError("can't send error message to caller:", err2, "about:", err)
 			}
 		}
 		return
@@ -38,9 +51,10 @@ func ParseParameters(
 	err = json.Unmarshal(data, v)
 	if err != nil {
 		if responder != nil {
-			err2 := responder.LogRespError(500, "error", "can't unmarshal input data")
-			if err != nil {
-				responder.Log("can't send error message to caller:", err2, "about:", err)
+			responder.Log("can't unmarshal input data:", err)
+			err2 := responder.ReplyWithError(ErrInvalidParams(err.Error()))
+			if err2 != nil {
+				responder.LogError("can't send error message to caller:", err2, "about:", err)
 			}
 		}
 		return
@@ -0,0 +1,225 @@
+package gojsonrpc2server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// RateLimitAnyMethod can be used as key in rate limit maps to limit all
+// methods which are not listed explicitly
+const RateLimitAnyMethod = "*"
+
+// reasons of request rejection, used as label for MetricRequestsRejected
+const (
+	rejectReasonSessionInFlight = "session_in_flight"
+	rejectReasonGlobalInFlight  = "global_in_flight"
+	rejectReasonSessionRate     = "session_rate"
+	rejectReasonGlobalRate      = "global_rate"
+)
+
+// RateLimit is token bucket: Rate requests per second are allowed on
+// average with bursts up to Burst requests. Burst less than 1 is treated
+// as 1
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	self := &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+	return self
+}
+
+func (self *tokenBucket) take(now time.Time) bool {
+	// now can be a bit earlier than creation time of bucket
+	if now.After(self.last) {
+		self.tokens += now.Sub(self.last).Seconds() * self.rate
+		if self.tokens > self.burst {
+			self.tokens = self.burst
+		}
+		self.last = now
+	}
+
+	if self.tokens < 1 {
+		return false
+	}
+
+	self.tokens--
+	return true
+}
+
+// rateLimiter keeps token bucket for each limited method. methods without
+// own limit share RateLimitAnyMethod bucket
+type rateLimiter struct {
+	limits  map[string]RateLimit
+	buckets map[string]*tokenBucket
+	mutex   *sync.Mutex
+}
+
+// checkRateLimits returns error if Rate of any of limits isn't positive.
+// name is name of option, used in error message
+func checkRateLimits(name string, limits map[string]RateLimit) error {
+	for k, v := range limits {
+		if v.Rate <= 0 {
+			return fmt.Errorf("%s[%q].Rate must be positive", name, k)
+		}
+	}
+	return nil
+}
+
+// returns nil if limits is empty
+func newRateLimiter(limits map[string]RateLimit) *rateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	t := make(map[string]RateLimit, len(limits))
+	for k, v := range limits {
+		t[k] = v
+	}
+
+	self := &rateLimiter{
+		limits:  t,
+		buckets: make(map[string]*tokenBucket),
+		mutex:   &sync.Mutex{},
+	}
+	return self
+}
+
+// can be called on nil *rateLimiter
+func (self *rateLimiter) allow(method string) bool {
+	if self == nil {
+		return true
+	}
+
+	key := method
+	limit, ok := self.limits[key]
+	if !ok {
+		key = RateLimitAnyMethod
+		limit, ok = self.limits[key]
+		if !ok {
+			return true
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	bucket, ok := self.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		self.buckets[key] = bucket
+	}
+
+	return bucket.take(time.Now())
+}
+
+// limitedHandler is used instead of jsonrpc2.AsyncHandler. it checks
+// in-flight and rate limits before request is handled (and before
+// goroutine is spawned for it, if handling is asynchronous)
+type limitedHandler struct {
+	session *Session
+	async   bool
+}
+
+var _ jsonrpc2.Handler = &limitedHandler{}
+
+func (self *limitedHandler) Handle(
+	ctx context.Context,
+	conn *jsonrpc2.Conn,
+	req *jsonrpc2.Request,
+) {
+	session := self.session
+	server := session.options.Server
+	options := server.options
+
+	reject := func(reason string, message string) {
+		options.Metrics.CounterAdd(
+			MetricRequestsRejected,
+			"number of requests rejected by limits",
+			1,
+			"reason", reason,
+			"transport", session.options.Transport,
+		)
+
+		session.LogError("request", req.Method, "rejected:", message)
+
+		if req.Notif {
+			return
+		}
+
+		err := conn.ReplyWithError(ctx, req.ID, ErrRateLimited(message))
+		if err != nil {
+			session.LogError("can't send error message to caller:", err)
+		}
+	}
+
+	session_in_flight := atomic.AddInt64(&session.in_flight, 1)
+	global_in_flight := atomic.AddInt64(&server.in_flight, 1)
+
+	done := func() {
+		atomic.AddInt64(&session.in_flight, -1)
+		atomic.AddInt64(&server.in_flight, -1)
+		// idle timeout is counted from end of request handling
+		session.touchActivity()
+	}
+
+	if options.MaxInFlightPerSession > 0 &&
+		session_in_flight > int64(options.MaxInFlightPerSession) {
+		done()
+		reject(rejectReasonSessionInFlight, "too many requests in progress")
+		return
+	}
+
+	if options.MaxInFlight > 0 &&
+		global_in_flight > int64(options.MaxInFlight) {
+		done()
+		reject(rejectReasonGlobalInFlight, "server is busy")
+		return
+	}
+
+	if !session.rate_limiter.allow(req.Method) {
+		done()
+		reject(rejectReasonSessionRate, "rate limit exceeded")
+		return
+	}
+
+	if !server.rate_limiter.allow(req.Method) {
+		done()
+		reject(rejectReasonGlobalRate, "server rate limit exceeded")
+		return
+	}
+
+	if !self.async {
+		defer done()
+		session.Handle(ctx, conn, req)
+		return
+	}
+
+	go func() {
+		defer done()
+		session.Handle(ctx, conn, req)
+	}()
+}
@@ -0,0 +1,159 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+
+	bucket := newTokenBucket(RateLimit{Rate: 10, Burst: 3})
+	now := bucket.last
+
+	for i := 0; i != 3; i++ {
+		if !bucket.take(now) {
+			t.Fatal("burst request", i, "is rejected")
+		}
+	}
+
+	if bucket.take(now) {
+		t.Fatal("request over burst is allowed")
+	}
+
+	// 10 per second - one token in 100ms
+	now = now.Add(50 * time.Millisecond)
+	if bucket.take(now) {
+		t.Fatal("request is allowed before token is refilled")
+	}
+
+	now = now.Add(50 * time.Millisecond)
+	if !bucket.take(now) {
+		t.Fatal("request is rejected after token is refilled")
+	}
+
+	// refill is limited by burst
+	now = now.Add(time.Hour)
+	for i := 0; i != 3; i++ {
+		if !bucket.take(now) {
+			t.Fatal("request", i, "is rejected after long pause")
+		}
+	}
+	if bucket.take(now) {
+		t.Fatal("tokens are accumulated over burst")
+	}
+}
+
+func TestTokenBucketZeroBurst(t *testing.T) {
+
+	bucket := newTokenBucket(RateLimit{Rate: 1})
+	now := bucket.last
+
+	if !bucket.take(now) || bucket.take(now) {
+		t.Fatal("zero burst must be treated as 1")
+	}
+}
+
+func TestRateLimiterMethods(t *testing.T) {
+
+	var limiter *rateLimiter
+	if !limiter.allow("a") {
+		t.Fatal("nil limiter must allow everything")
+	}
+
+	limiter = newRateLimiter(
+		map[string]RateLimit{
+			"a":                {Burst: 1},
+			RateLimitAnyMethod: {Burst: 2},
+		},
+	)
+
+	if !limiter.allow("a") || limiter.allow("a") {
+		t.Fatal("method limit isn't applied")
+	}
+
+	// "b" and "c" share RateLimitAnyMethod bucket
+	if !limiter.allow("b") || !limiter.allow("c") || limiter.allow("b") {
+		t.Fatal("RateLimitAnyMethod limit isn't applied")
+	}
+}
+
+func TestRequestRejectionReasons(t *testing.T) {
+
+	metrics := NewMetrics("test")
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			Metrics: metrics,
+			SessionRateLimits: map[string]RateLimit{
+				"session_limited": {Rate: 0.001, Burst: 1},
+			},
+			GlobalRateLimits: map[string]RateLimit{
+				"global_limited": {Rate: 0.001, Burst: 2},
+			},
+		},
+		nil,
+	)
+
+	// each HTTP POST request has own session, so session limit is applied
+	// inside batch only, and global limit - across requests
+	_, body := testPost(
+		t,
+		address,
+		`[{"jsonrpc":"2.0","id":1,"method":"session_limited"},`+
+			`{"jsonrpc":"2.0","id":2,"method":"session_limited"}]`,
+	)
+	if strings.Count(body, `"code":-32002`) != 1 {
+		t.Fatal("session limit isn't applied:", body)
+	}
+
+	_, body = testPost(
+		t,
+		address,
+		`{"jsonrpc":"2.0","id":1,"method":"session_limited"}`,
+	)
+	if strings.Contains(body, `"error"`) {
+		t.Fatal("session limit is shared by sessions:", body)
+	}
+
+	for i := 0; i != 3; i++ {
+		_, body = testPost(
+			t,
+			address,
+			`{"jsonrpc":"2.0","id":1,"method":"global_limited"}`,
+		)
+	}
+	if !strings.Contains(body, `"code":-32002`) {
+		t.Fatal("global limit isn't applied:", body)
+	}
+
+	b := &bytes.Buffer{}
+	metrics.WritePrometheus(b)
+	out := b.String()
+
+	for _, i := range []string{
+		`test_requests_rejected_total{reason="session_rate",transport="http"} 1`,
+		`test_requests_rejected_total{reason="global_rate",transport="http"} 1`,
+	} {
+		if !strings.Contains(out, i) {
+			t.Fatal("metrics don't contain", i, ":\n", out)
+		}
+	}
+}
+
+func TestNewServerRejectsRateLimitsWithoutRate(t *testing.T) {
+
+	for _, opts := range []*ServerOptions{
+		{SessionRateLimits: map[string]RateLimit{"a": {Burst: 10}}},
+		{GlobalRateLimits: map[string]RateLimit{RateLimitAnyMethod: {Rate: -1}}},
+		{GlobalRateLimits: map[string]RateLimit{"a": {}}},
+	} {
+		opts.Logger = LogFunc(func(...interface{}) {})
+		_, err := NewServer(opts)
+		if err == nil {
+			t.Fatal("limits without rate are accepted:", opts.SessionRateLimits, opts.GlobalRateLimits)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+var (
+	rpc_handle_context_type = reflect.TypeOf((*RPCHandleContext)(nil))
+	error_type              = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type routerHandler struct {
+	fn          reflect.Value
+	params_type reflect.Type
+}
+
+// Router is a method registry which can be used by AppContextSession
+// implementations instead of hand-written switch on Req.Method.
+//
+// Handlers are functions of form
+//
+//	func(ctx *RPCHandleContext, params P) (result R, err error)
+//
+// where P is any type json can be unmarshaled into (usually pointer to
+// struct). If err is *jsonrpc2.Error, it is sent to caller as is.
+type Router struct {
+	handlers       map[string]*routerHandler
+	handlers_mutex *sync.RWMutex
+}
+
+func NewRouter() *Router {
+	self := &Router{
+		handlers:       make(map[string]*routerHandler),
+		handlers_mutex: &sync.RWMutex{},
+	}
+	return self
+}
+
+// Register handler for method. handler is checked to have correct signature
+func (self *Router) Register(method string, handler interface{}) error {
+
+	if method == "" {
+		return errors.New("method name must not be empty")
+	}
+
+	fn := reflect.ValueOf(handler)
+	if !fn.IsValid() || fn.Kind() != reflect.Func || fn.IsNil() {
+		return fmt.Errorf("handler for %s must be a function", method)
+	}
+
+	fn_type := fn.Type()
+
+	if fn_type.NumIn() != 2 || fn_type.In(0) != rpc_handle_context_type {
+		return fmt.Errorf(
+			"handler for %s must accept (*RPCHandleContext, params) as input",
+			method,
+		)
+	}
+
+	if fn_type.NumOut() != 2 || fn_type.Out(1) != error_type {
+		return fmt.Errorf(
+			"handler for %s must return (result, error)",
+			method,
+		)
+	}
+
+	self.handlers_mutex.Lock()
+	defer self.handlers_mutex.Unlock()
+
+	if _, ok := self.handlers[method]; ok {
+		return fmt.Errorf("handler for %s already registered", method)
+	}
+
+	self.handlers[method] = &routerHandler{
+		fn:          fn,
+		params_type: fn_type.In(1),
+	}
+
+	return nil
+}
+
+func (self *Router) Unregister(method string) {
+	self.handlers_mutex.Lock()
+	defer self.handlers_mutex.Unlock()
+
+	delete(self.handlers, method)
+}
+
+func (self *Router) HasMethod(method string) bool {
+	self.handlers_mutex.RLock()
+	defer self.handlers_mutex.RUnlock()
+
+	_, ok := self.handlers[method]
+	return ok
+}
+
+// Methods returns list of registered methods names
+func (self *Router) Methods() []string {
+	self.handlers_mutex.RLock()
+	defer self.handlers_mutex.RUnlock()
+
+	ret := make([]string, 0, len(self.handlers))
+	for k, _ := range self.handlers {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+// RPCHandle can be called from AppContextSession.RPCHandle() to dispatch
+// request to registered handler
+func (self *Router) RPCHandle(ctx *RPCHandleContext) {
+
+	responder := ctx.Responder
+	if responder == nil {
+		var logger Logger = LogFunc(log.Println)
+		if ctx.Session != nil {
+			logger = ctx.Session.GetLogger()
+		}
+
+		responder = NewHandleResponderWithLogger(
+			ctx.Ctx,
+			ctx.Conn,
+			ctx.Req,
+			uuid.NewV4().String(),
+			logger,
+		)
+	}
+
+	if !ctx.Req.Notif {
+		defer func() {
+			x := recover()
+			if x != nil {
+				if ctx.Session == nil {
+					panic(x)
+				}
+				// report panic before default reply of Defer()
+				ctx.Session.handlePanic(ctx, responder, x, debug.Stack())
+			}
+			responder.Defer()
+		}()
+	}
+
+	self.handlers_mutex.RLock()
+	h, ok := self.handlers[ctx.Req.Method]
+	self.handlers_mutex.RUnlock()
+
+	if !ok {
+		if ctx.Req.Notif {
+			responder.Log("notification for unknown method:", ctx.Req.Method)
+			return
+		}
+		responder.Log("method not found:", ctx.Req.Method)
+		err := responder.ReplyWithError(ErrMethodNotFound(ctx.Req.Method))
+		if err != nil {
+			responder.LogError("can't send error message to caller:", err)
+		}
+		return
+	}
+
+	params_is_ptr := h.params_type.Kind() == reflect.Ptr
+
+	var params reflect.Value
+	if params_is_ptr {
+		params = reflect.New(h.params_type.Elem())
+	} else {
+		params = reflect.New(h.params_type)
+	}
+
+	if ctx.Req.Params != nil {
+		resp := responder
+		if ctx.Req.Notif {
+			resp = nil
+		}
+
+		cancel_processing, _ := ParseParameters(resp, ctx.Req.Params, params.Interface())
+		if cancel_processing {
+			if ctx.Req.Notif {
+				responder.LogError("can't parse notification parameters for", ctx.Req.Method)
+			}
+			return
+		}
+	}
+
+	if !params_is_ptr {
+		params = params.Elem()
+	}
+
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(ctx), params})
+
+	result := out[0].Interface()
+
+	var err error
+	if !out[1].IsNil() {
+		err = out[1].Interface().(error)
+	}
+
+	if ctx.Req.Notif {
+		if err != nil {
+			responder.LogError("notification handler error:", err)
+		}
+		return
+	}
+
+	if err != nil {
+		if rpc_err, ok := err.(*jsonrpc2.Error); ok {
+			err = responder.ReplyWithError(rpc_err)
+		} else {
+			err = responder.RespError(CodeInternalError, err.Error())
+		}
+	} else {
+		err = responder.Reply(result)
+	}
+
+	if err != nil {
+		responder.LogError("can't send reply to caller:", err)
+	}
+}
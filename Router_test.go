@@ -0,0 +1,215 @@
+package gojsonrpc2server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPanicParams struct {
+	Value string
+}
+
+func TestRouterPanicRepliesWithInternalError(t *testing.T) {
+
+	router := NewRouter()
+	err := router.Register(
+		"panic",
+		func(ctx *RPCHandleContext, params *testPanicParams) (interface{}, error) {
+			panic("test panic " + params.Value)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	panics := make(chan interface{}, 1)
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			PanicHandler: func(ctx *RPCHandleContext, recovered interface{}, stack []byte) {
+				panics <- recovered
+				panic("panic in panic handler")
+			},
+		},
+		router.RPCHandle,
+	)
+
+	_, body := testPost(
+		t,
+		address,
+		`{"jsonrpc":"2.0","id":1,"method":"panic","params":{"Value":"x"}}`,
+	)
+
+	if !strings.Contains(body, `"code":-32603`) {
+		t.Fatal("expected internal error, got:", body)
+	}
+
+	if strings.Contains(body, "didn't respond") {
+		t.Fatal("got default reply instead of panic error:", body)
+	}
+
+	select {
+	case x := <-panics:
+		if x != "test panic x" {
+			t.Fatal("unexpected value passed to PanicHandler:", x)
+		}
+	default:
+		t.Fatal("PanicHandler wasn't called")
+	}
+}
+
+type testSumParams struct {
+	A int
+	B int
+}
+
+func testRouter(t *testing.T) (*Router, chan string) {
+	t.Helper()
+
+	notified := make(chan string, 10)
+
+	router := NewRouter()
+
+	for method, handler := range map[string]interface{}{
+		"sum": func(ctx *RPCHandleContext, params *testSumParams) (interface{}, error) {
+			return params.A + params.B, nil
+		},
+		"len": func(ctx *RPCHandleContext, params []int) (int, error) {
+			return len(params), nil
+		},
+		"rpc_error": func(ctx *RPCHandleContext, params interface{}) (interface{}, error) {
+			return nil, NewError(42, "custom", "data")
+		},
+		"error": func(ctx *RPCHandleContext, params interface{}) (interface{}, error) {
+			return nil, errors.New("plain error")
+		},
+		"notify": func(ctx *RPCHandleContext, params string) (interface{}, error) {
+			notified <- params
+			return nil, nil
+		},
+	} {
+		err := router.Register(method, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return router, notified
+}
+
+func TestRouterCalls(t *testing.T) {
+
+	router, _ := testRouter(t)
+
+	_, address := testStartHTTPServer(t, nil, router.RPCHandle)
+
+	for _, i := range []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"sum","params":{"A":1,"B":2}}`,
+			`"result":3`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"len","params":[1,2,3]}`,
+			`"result":3`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"sum","params":"wrong"}`,
+			`"code":-32602`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"unknown"}`,
+			`"code":-32601`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"rpc_error"}`,
+			`"error":{"code":42,"message":"custom","data":"data"}`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"error"}`,
+			`"code":-32603`,
+		},
+	} {
+		_, body := testPost(t, address, i.request)
+		if !strings.Contains(body, i.expected) {
+			t.Fatal("request", i.request, "expected", i.expected, "got:", body)
+		}
+	}
+}
+
+func TestRouterNotification(t *testing.T) {
+
+	router, notified := testRouter(t)
+
+	_, address := testStartHTTPServer(t, nil, router.RPCHandle)
+
+	status, body := testPost(t, address, `{"jsonrpc":"2.0","method":"notify","params":"x"}`)
+	if status != http.StatusNoContent || body != "" {
+		t.Fatal("unexpected response to notification:", status, body)
+	}
+
+	select {
+	case x := <-notified:
+		if x != "x" {
+			t.Fatal("unexpected parameter:", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification handler isn't called")
+	}
+
+	// notification of unknown method isn't replied
+	status, body = testPost(t, address, `{"jsonrpc":"2.0","method":"unknown"}`)
+	if status != http.StatusNoContent || body != "" {
+		t.Fatal("unexpected response to notification:", status, body)
+	}
+}
+
+func TestRouterRegisterChecksSignature(t *testing.T) {
+
+	router := NewRouter()
+
+	for name, handler := range map[string]interface{}{
+		"nil":            nil,
+		"not function":   1,
+		"no params":      func(ctx *RPCHandleContext) (interface{}, error) { return nil, nil },
+		"no context":     func(a int, b int) (interface{}, error) { return nil, nil },
+		"no error":       func(ctx *RPCHandleContext, params int) (interface{}, int) { return nil, 0 },
+		"single result":  func(ctx *RPCHandleContext, params int) error { return nil },
+		"too many input": func(ctx *RPCHandleContext, a int, b int) (interface{}, error) { return nil, nil },
+	} {
+		err := router.Register("method", handler)
+		if err == nil {
+			t.Fatal("handler is accepted:", name)
+		}
+	}
+
+	if router.Register("", func(ctx *RPCHandleContext, params int) (int, error) { return 0, nil }) == nil {
+		t.Fatal("empty method name is accepted")
+	}
+
+	ok := func(ctx *RPCHandleContext, params int) (int, error) { return 0, nil }
+
+	if err := router.Register("method", ok); err != nil {
+		t.Fatal(err)
+	}
+
+	if router.Register("method", ok) == nil {
+		t.Fatal("method is registered twice")
+	}
+
+	if !router.HasMethod("method") {
+		t.Fatal("registered method isn't found")
+	}
+
+	router.Unregister("method")
+
+	if router.HasMethod("method") {
+		t.Fatal("method isn't unregistered")
+	}
+}
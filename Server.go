@@ -1,10 +1,17 @@
 package gojsonrpc2server
 
 import (
+	"context"
 	"crypto/tls"
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AnimusPEXUS/utils/worker"
@@ -15,57 +22,660 @@ import (
 	jsonrpc2websocket "github.com/sourcegraph/jsonrpc2/websocket"
 )
 
+var ErrServerShuttingDown = errors.New("server is shutting down")
+
 type ServerOptions struct {
 	// Verbose bool
 	Debug bool
 
-	ListenAtAddresses    string
-	ListenAtAddressesWS  string
+	// records of server and it's sessions are sent here. if nil, StdLogger
+	// is used (with debug records enabled if Debug is true)
+	Logger Logger
+
+	// each address gets own listener with own worker, which is restarted
+	// independently from others if it fails
+	ListenAtAddresses    []string
+	ListenAtAddressesWS  []string
 	AsyncRequestHandling bool
 
+	// framing used on TCP connections. nil means jsonrpc2.VarintObjectCodec.
+	// see also NewlineObjectCodec, jsonrpc2.VSCodeObjectCodec and CodecByName()
+	TCPCodec jsonrpc2.ObjectCodec
+
+	// paths to unix sockets to listen at additionally to ListenAtAddresses.
+	// connections are handled same way as tcp ones (TLS is not used)
+	ListenAtUnixSockets []string
+	// permissions to set on socket files. socket appears at path only
+	// after they are set. 0 means not to change them
+	UnixSocketPermissions os.FileMode
+	// remove socket file left from previous run, if nobody listens it
+	RemoveStaleUnixSocket bool
+
 	// AppContext AppContext
 	CreateAppContextSession func(Destructable) (AppContextSession, error)
 	EnableTLS               bool
 	TLSConfig               *tls.Config
+	// 0 means DefaultTLSHandshakeTimeout. used for TCP connections
+	TLSHandshakeTimeout time.Duration
+
+	// certificate hot-reload for TCP and WebSocket listeners. if
+	// TLSCertFile and TLSKeyFile are set, certificate is loaded from them
+	// and reloaded when they change (checked not more often than
+	// TLSReloadInterval). TLSGetCertificate can be used instead to provide
+	// certificates by other means. in both cases TLSConfig.Certificates is
+	// ignored. new certificates are used for new handshakes only, existing
+	// connections are not affected
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration // default is DefaultTLSReloadInterval
+	TLSGetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// WebSocket endpoint settings for ListenAtAddressesWS.
+	//
+	// WSAllowedOrigins lists origins browsers are allowed to connect from:
+	// "*", full origin ("https://example.com") or host ("example.com:8080").
+	// nil means only same origin requests are allowed. requests without
+	// Origin header are always allowed.
+	//
+	// WSReadLimit is maximum size of incoming message. 0 means no limit
+	WSPath              string // default is DefaultWSPath
+	WSAllowedOrigins    []string
+	WSReadBufferSize    int // default is DefaultWSBufferSize
+	WSWriteBufferSize   int // default is DefaultWSBufferSize
+	WSSubprotocols      []string
+	WSEnableCompression bool
+	WSReadLimit         int64
+
+	// WebSocket clients are pinged every WSPingInterval (0 disables pings).
+	// connection is closed if pong isn't received in
+	// WSPingInterval + WSPongTimeout (WSPongTimeout 0 means WSPingInterval)
+	WSPingInterval time.Duration
+	WSPongTimeout  time.Duration
+
+	// keep-alive period for accepted TCP connections. 0 means Go default,
+	// negative value disables keep-alives
+	TCPKeepAlivePeriod time.Duration
+
+	// session is destroyed if no JSON-RPC messages are received or sent
+	// during this time. WebSocket pings are not counted. 0 means no
+	// timeout. not used for HTTP POST
+	SessionIdleTimeout time.Duration
 
 	HostStaticDir          bool
 	StaticDir              string
 	StaticDirURIPathPrefix string
+
+	// serve JSON-RPC requests received with plain HTTP POST on all
+	// ListenAtAddressesWS. single requests and batches are supported
+	EnableHTTPPost      bool
+	HTTPPostPath        string        // default is DefaultHTTPPostPath
+	HTTPPostMaxBodySize int64         // default is DefaultHTTPPostMaxBodySize
+	HTTPPostTimeout     time.Duration // default is DefaultHTTPPostTimeout
+
+	// if not nil, sessions, requests, responses, handler durations and panics
+	// are recorded here. metrics are exposed at MetricsPath on all
+	// ListenAtAddressesWS
+	Metrics     *Metrics
+	MetricsPath string // default is DefaultMetricsPath
+
+	// server side authentication. if any of authenticators is set, sessions
+	// are created unauthenticated and all requests except AuthMethod are
+	// rejected with CodeUnauthorized until authentication succeeds.
+	// unauthenticated sessions are destroyed after AuthTimeout.
+	//
+	// Authenticator is called for AuthMethod requests. returned principal
+	// is attached to session (see Session.GetPrincipal()). if err is
+	// *jsonrpc2.Error, it's sent to client as is. if authentication of
+	// already authenticated session fails, session's principal is dropped
+	// and session must authenticate again.
+	//
+	// HTTPAuthenticator is called on WebSocket upgrade and HTTP POST
+	// requests (see BearerToken()). if it returns error, request is
+	// rejected with 401 status. if it returns nil principal and nil error,
+	// session is created unauthenticated (so Authenticator must be set
+	// too, else request is rejected with 401 status)
+	Authenticator     func(ctx *RPCHandleContext) (principal interface{}, err error)
+	HTTPAuthenticator func(r *http.Request) (principal interface{}, err error)
+	AuthMethod        string        // default is DefaultAuthMethod
+	AuthTimeout       time.Duration // default is DefaultAuthTimeout
+
+	// interceptors called for each request before
+	// AppContextSession.RPCHandle(). first is outermost. they are called
+	// before authentication checks too, so they get AuthMethod requests
+	// and requests of unauthenticated sessions (Session.IsAuthenticated()
+	// tells if session is authenticated already)
+	Interceptors []Interceptor
+
+	// limits of requests being handled (or waiting to be handled) at same
+	// time, per session and for whole server. requests over limits are
+	// rejected with CodeRateLimited. 0 means no limit. with
+	// AsyncRequestHandling disabled only one request per session is
+	// handled at once anyway
+	MaxInFlightPerSession int
+	MaxInFlight           int
+
+	// token bucket rate limits by method name, per session and for whole
+	// server. RateLimitAnyMethod key limits methods not listed explicitly
+	// (all of them share one bucket). requests over limits are rejected
+	// with CodeRateLimited. Rate of each RateLimit must be positive
+	SessionRateLimits map[string]RateLimit
+	GlobalRateLimits  map[string]RateLimit
+
+	// limits of sessions of all transports, total and per remote ip. 0
+	// means no limit
+	MaxSessions      int
+	MaxSessionsPerIP int
+
+	// token bucket limits of new TCP, unix socket and WebSocket
+	// connections and HTTP POST requests, total and per remote ip. zero
+	// RateLimit means no limit. Rate of non-zero RateLimit must be positive
+	AcceptRateLimit      RateLimit
+	AcceptRateLimitPerIP RateLimit
+
+	// called if RPC handler panics. request is replied with internal error
+	// after this, if handler didn't respond already. can be nil
+	PanicHandler func(ctx *RPCHandleContext, recovered interface{}, stack []byte)
+}
+
+type listenerWorker struct {
+	name   string
+	worker *worker.Worker
 }
 
 type Server struct {
 	options *ServerOptions
 
-	mainworker *worker.Worker
-	tcpworker  *worker.Worker
-	httpworker *worker.Worker
+	mainworker      *worker.Worker
+	listenerworkers []*listenerWorker
+
+	root_logger Logger
+	loggerHolder
+
+	handler HandlerFunc
+
+	tls_config *tls.Config
+
+	rate_limiter   *rateLimiter
+	accept_limiter *acceptLimiter
+
+	ws_upgrader *websocket.Upgrader
+
+	sessions        map[string]*Session
+	sessions_per_ip map[string]int
+	sessions_mutex  *sync.RWMutex
+
+	listeners       []net.Listener
+	http_servers    []*http.Server
+	listeners_mutex *sync.Mutex
+
+	// closed when first Shutdown() or Destroy() call is finished
+	shutdown_done chan struct{}
+
+	// accessed atomically
+	shutting_down int32
+	// requests accepted by limitedHandler and not handled yet. it's
+	// incremented before handling goroutine is spawned, so Shutdown()
+	// waits for all admitted requests
+	in_flight int64
+	// accepted connections which aren't passed to sessions yet
+	accepting int64
 }
 
 func NewServer(opts *ServerOptions) (*Server, error) {
 
 	self := &Server{
-		options: opts,
+		options:         opts,
+		sessions:        make(map[string]*Session),
+		sessions_per_ip: make(map[string]int),
+		sessions_mutex:  &sync.RWMutex{},
+		listeners_mutex: &sync.Mutex{},
+		shutdown_done:   make(chan struct{}),
+	}
+
+	self.root_logger = opts.Logger
+	if self.root_logger == nil {
+		min_level := LogLevelInfo
+		if opts.Debug {
+			min_level = LogLevelDebug
+		}
+		self.root_logger = NewStdLogger(nil, min_level)
+	}
+
+	self.logger = WithFields(self.root_logger, LogFieldComponent, "server")
+
+	err := self.prepareTLSConfig()
+	if err != nil {
+		return nil, err
 	}
 
+	self.ws_upgrader = self.makeWSUpgrader()
+
+	err = checkRateLimits("SessionRateLimits", self.options.SessionRateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRateLimits("GlobalRateLimits", self.options.GlobalRateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	self.rate_limiter = newRateLimiter(self.options.GlobalRateLimits)
+	self.accept_limiter, err = newAcceptLimiter(
+		self.options.AcceptRateLimit,
+		self.options.AcceptRateLimitPerIP,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	self.handler = ChainInterceptors(opts.Interceptors...)(
+		func(ctx *RPCHandleContext) {
+			ctx.Session.handleRouted(ctx)
+		},
+	)
+
 	self.mainworker = worker.New(self.mainThread)
-	self.tcpworker = worker.New(self.tcpThread)
-	self.httpworker = worker.New(self.httpThread)
+
+	for _, i := range opts.ListenAtAddresses {
+		self.addListenerWorker("tcp", i, self.tcpThread)
+	}
+
+	for _, i := range opts.ListenAtUnixSockets {
+		self.addListenerWorker("unix", i, self.unixThread)
+	}
+
+	for _, i := range opts.ListenAtAddressesWS {
+		self.addListenerWorker("http", i, self.httpThread)
+	}
 
 	return self, nil
 }
 
-func (self *Server) Log(txt ...interface{}) {
-	t := []interface{}{"[server]"}
-	t = append(t, txt...)
-	log.Println(t...)
+func (self *Server) prepareTLSConfig() error {
+
+	self.tls_config = self.options.TLSConfig
+
+	get_certificate := self.options.TLSGetCertificate
+
+	if get_certificate == nil &&
+		(self.options.TLSCertFile != "" || self.options.TLSKeyFile != "") {
+
+		reloader, err := NewCertificateReloader(
+			self.options.TLSCertFile,
+			self.options.TLSKeyFile,
+			self.options.TLSReloadInterval,
+			self.logger,
+		)
+		if err != nil {
+			return err
+		}
+
+		get_certificate = reloader.GetCertificate
+	}
+
+	if get_certificate != nil {
+		if self.tls_config == nil {
+			self.tls_config = &tls.Config{}
+		} else {
+			self.tls_config = self.tls_config.Clone()
+		}
+		self.tls_config.Certificates = nil
+		self.tls_config.GetCertificate = get_certificate
+	}
+
+	return nil
+}
+
+func (self *Server) addListenerWorker(
+	name string,
+	address string,
+	thread func(
+		address string,
+
+		set_starting func(),
+		set_working func(),
+		set_stopping func(),
+		set_stopped func(),
+
+		is_stop_flag func() bool,
+	),
+) {
+	self.listenerworkers = append(
+		self.listenerworkers,
+		&listenerWorker{
+			name: name + " " + address,
+			worker: worker.New(
+				func(
+					set_starting func(),
+					set_working func(),
+					set_stopping func(),
+					set_stopped func(),
+
+					is_stop_flag func() bool,
+				) {
+					thread(
+						address,
+						set_starting,
+						set_working,
+						set_stopping,
+						set_stopped,
+						is_stop_flag,
+					)
+				},
+			),
+		},
+	)
 }
 
 func (self *Server) GetWorker() worker.WorkerI {
 	return self.mainworker
 }
 
+// Destroy stops server immediately, without waiting for in-flight calls
+// and accepted connections. Use Shutdown() for graceful stop
 func (self *Server) Destroy() {
+	self.shutdown(context.Background(), false)
+}
+
+// Shutdown stops accepting new connections on all listeners, waits for
+// in-flight calls and for accepted connections (TLS handshakes) to finish
+// until ctx is done and then destroys all remaining sessions. Server can't
+// be started again after Shutdown. Returns ctx.Err() if ctx is done before
+// in-flight calls finished. If shutdown is already in progress, waits for
+// it to finish.
+func (self *Server) Shutdown(ctx context.Context) error {
+	return self.shutdown(ctx, true)
+}
+
+func (self *Server) shutdown(ctx context.Context, graceful bool) error {
+
+	self.listeners_mutex.Lock()
+	first := atomic.CompareAndSwapInt32(&self.shutting_down, 0, 1)
+	self.listeners_mutex.Unlock()
+
+	if !first {
+		if !graceful {
+			self.Log("shutdown: already shutting down. destroying sessions")
+			self.destroySessions()
+			return nil
+		}
+
+		self.Log("shutdown: already shutting down. waiting for it to finish")
+		select {
+		case <-self.shutdown_done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	defer close(self.shutdown_done)
+
+	// workers aren't stopped with Stop(), as it isn't safe to call
+	// concurrently with worker threads. they exit as they see
+	// shutting_down or closed listeners
+	self.Log("shutdown: stopping listeners")
+
+	self.listeners_mutex.Lock()
+	listeners := make([]net.Listener, len(self.listeners))
+	copy(listeners, self.listeners)
+	http_servers := make([]*http.Server, len(self.http_servers))
+	copy(http_servers, self.http_servers)
+	self.listeners_mutex.Unlock()
+
+	var ret error
+
+	for _, i := range listeners {
+		self.Log("shutdown: closing listener", i.Addr().String())
+		i.Close()
+	}
+
+	for _, i := range http_servers {
+		if !graceful {
+			self.Log("shutdown: closing http server", i.Addr)
+			i.Close()
+			continue
+		}
+
+		self.Log("shutdown: shutting down http server", i.Addr)
+		err := i.Shutdown(ctx)
+		if err != nil {
+			self.LogError("shutdown: http server shutdown error:", err)
+			ret = err
+		}
+	}
+
+	if graceful {
+		self.Log("shutdown: waiting for accepted connections and in-flight calls")
+
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+	wait_loop:
+		for {
+			accepting := atomic.LoadInt64(&self.accepting)
+			count := atomic.LoadInt64(&self.in_flight)
+			if accepting == 0 && count == 0 {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				self.Log(
+					"shutdown: not waiting any more. in-flight calls left:", count,
+					"accepted connections left:", accepting,
+				)
+				ret = ctx.Err()
+				break wait_loop
+			case <-ticker.C:
+			}
+		}
+	}
+
+	self.destroySessions()
+
+	self.Log("shutdown: done")
+
+	return ret
+}
 
+func (self *Server) destroySessions() {
+	sessions := self.Sessions()
+
+	self.Log("shutdown: destroying sessions:", len(sessions))
+
+	for _, i := range sessions {
+		i.Destroy()
+	}
+}
+
+func (self *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&self.shutting_down) != 0
+}
+
+func (self *Server) registerSession(session *Session) error {
+	self.sessions_mutex.Lock()
+	defer self.sessions_mutex.Unlock()
+
+	if self.isShuttingDown() {
+		return ErrServerShuttingDown
+	}
+
+	ip := remoteIP(session.GetRemoteAddr())
+
+	err := self.sessionLimitError(self.checkSessionLimitsLocked(ip))
+	if err != nil {
+		return err
+	}
+
+	self.sessions[session.GetSessionId()] = session
+	if ip != "" {
+		self.sessions_per_ip[ip]++
+	}
+
+	self.options.Metrics.GaugeAdd(
+		MetricSessionsActive,
+		"number of currently active sessions",
+		1,
+		"transport", session.GetTransport(),
+	)
+	self.options.Metrics.CounterAdd(
+		MetricSessionsTotal,
+		"number of sessions created",
+		1,
+		"transport", session.GetTransport(),
+	)
+
+	return nil
+}
+
+func (self *Server) unregisterSession(session *Session) {
+	self.sessions_mutex.Lock()
+	defer self.sessions_mutex.Unlock()
+
+	if x, ok := self.sessions[session.GetSessionId()]; ok && x == session {
+		delete(self.sessions, session.GetSessionId())
+
+		ip := remoteIP(session.GetRemoteAddr())
+		if ip != "" {
+			self.sessions_per_ip[ip]--
+			if self.sessions_per_ip[ip] <= 0 {
+				delete(self.sessions_per_ip, ip)
+			}
+		}
+
+		self.options.Metrics.GaugeAdd(
+			MetricSessionsActive,
+			"number of currently active sessions",
+			-1,
+			"transport", session.GetTransport(),
+		)
+	}
+}
+
+// Sessions returns snapshot of currently registered sessions
+func (self *Server) Sessions() []*Session {
+	self.sessions_mutex.RLock()
+	defer self.sessions_mutex.RUnlock()
+
+	ret := make([]*Session, 0, len(self.sessions))
+	for _, i := range self.sessions {
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// SessionByID returns session with given id (see Session.GetSessionId())
+func (self *Server) SessionByID(id string) (*Session, bool) {
+	self.sessions_mutex.RLock()
+	defer self.sessions_mutex.RUnlock()
+
+	ret, ok := self.sessions[id]
+	return ret, ok
+}
+
+func (self *Server) SessionCount() int {
+	self.sessions_mutex.RLock()
+	defer self.sessions_mutex.RUnlock()
+
+	return len(self.sessions)
+}
+
+// Broadcast sends notification to all sessions for which filter returns
+// true. filter can be nil - so notification is sent to all sessions.
+// HTTP POST sessions are skipped. Sending is done concurrently, function
+// returns after all sessions are notified or when ctx is done - sessions
+// which are too slow to receive notification till then are skipped
+// (sending to them continues in background). Errors are logged.
+func (self *Server) Broadcast(
+	ctx context.Context,
+	method string,
+	params interface{},
+	filter func(*Session) bool,
+) {
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	var left int64
+
+	for _, i := range self.Sessions() {
+		if i.GetTransport() == TransportHTTP {
+			continue
+		}
+
+		if filter != nil && !filter(i) {
+			continue
+		}
+
+		wg.Add(1)
+		atomic.AddInt64(&left, 1)
+		go func(s *Session) {
+			defer wg.Done()
+			err := s.Notify(ctx, method, params)
+			atomic.AddInt64(&left, -1)
+			if err != nil {
+				s.LogError("broadcast: can't send notification", method, "to client:", err)
+			}
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		self.LogError(
+			"broadcast:", method, "not delivered in time to sessions:",
+			atomic.LoadInt64(&left),
+		)
+	}
+}
+
+// returns false if server is shutting down, so listener must not be used
+func (self *Server) addListener(listener net.Listener) bool {
+	self.listeners_mutex.Lock()
+	defer self.listeners_mutex.Unlock()
+	if self.isShuttingDown() {
+		return false
+	}
+	self.listeners = append(self.listeners, listener)
+	return true
+}
+
+func (self *Server) removeListener(listener net.Listener) {
+	self.listeners_mutex.Lock()
+	defer self.listeners_mutex.Unlock()
+	for i := len(self.listeners) - 1; i != -1; i -= 1 {
+		if self.listeners[i] == listener {
+			self.listeners = append(self.listeners[:i], self.listeners[i+1:]...)
+		}
+	}
+}
+
+// returns false if server is shutting down, so http server must not be
+// started
+func (self *Server) addHTTPServer(server *http.Server) bool {
+	self.listeners_mutex.Lock()
+	defer self.listeners_mutex.Unlock()
+	if self.isShuttingDown() {
+		return false
+	}
+	self.http_servers = append(self.http_servers, server)
+	return true
+}
+
+func (self *Server) removeHTTPServer(server *http.Server) {
+	self.listeners_mutex.Lock()
+	defer self.listeners_mutex.Unlock()
+	for i := len(self.http_servers) - 1; i != -1; i -= 1 {
+		if self.http_servers[i] == server {
+			self.http_servers = append(self.http_servers[:i], self.http_servers[i+1:]...)
+		}
+	}
 }
 
 func (self *Server) mainThread(
@@ -87,19 +697,17 @@ func (self *Server) mainThread(
 
 	set_working()
 	for {
-		if self.tcpworker.Status().IsStopped() {
-			self.Log("tcp worker is stopped: starting")
-			self.tcpworker.Start()
+		if is_stop_flag() || self.isShuttingDown() {
+			break
 		}
 
-		if self.httpworker.Status().IsStopped() {
-			self.Log("http worker is stopped: starting")
-			self.httpworker.Start()
+		for _, i := range self.listenerworkers {
+			if i.worker.Status().IsStopped() {
+				self.Log(i.name, "worker is stopped: starting")
+				i.worker.Start()
+			}
 		}
 
-		if is_stop_flag() {
-			break
-		}
 		time.Sleep(time.Second)
 	}
 	set_stopping()
@@ -107,6 +715,8 @@ func (self *Server) mainThread(
 }
 
 func (self *Server) tcpThread(
+	address string,
+
 	set_starting func(),
 	set_working func(),
 	set_stopping func(),
@@ -122,102 +732,355 @@ func (self *Server) tcpThread(
 		set_stopped()
 	}()
 
-	self.Log("tcp: resolving address:", self.options.ListenAtAddresses)
-	tcp_addr, err := net.ResolveTCPAddr("tcp", self.options.ListenAtAddresses)
+	self.LogDebug("tcp: resolving address:", address)
+	tcp_addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
-		self.Log("error:", err)
+		self.LogError(err)
 		return
 	}
 
-	self.Log("tcp: creating listener")
+	self.LogDebug("tcp: creating listener")
 	listener, err := net.ListenTCP("tcp", tcp_addr)
 	if err != nil {
-		self.Log("error:", err)
+		self.LogError(err)
 		return
 	}
 	self.Log("tcp: listening at", listener.Addr().String())
 
+	if !self.addListener(listener) {
+		listener.Close()
+		return
+	}
+
 	defer func() {
+		self.removeListener(listener)
 		listener.Close()
 	}()
 
-	go func() {
-		for {
-			if is_stop_flag() {
-				self.Log("tcp: listener got stop signal. exiting..")
-				listener.Close()
-				break
-			}
+	set_working()
 
-			time.Sleep(time.Second)
-		}
+	self.Log("tcp: worker is working. entering main listening loop")
+
+	self.acceptLoop("tcp "+address, TransportTCP, listener, self.options.EnableTLS, is_stop_flag)
+
+	set_stopping()
+}
+
+func (self *Server) unixThread(
+	address string,
+
+	set_starting func(),
+	set_working func(),
+	set_stopping func(),
+	set_stopped func(),
+
+	is_stop_flag func() bool,
+) {
+	self.Log("unix: listening thread is starting")
+	set_starting()
+
+	defer func() {
+		self.Log("unix: listening thread exited")
+		set_stopped()
 	}()
 
-	set_working()
+	path := address
 
-	self.Log("tcp: worker is working. entering main listening loop")
+	err := prepareUnixSocketPath(path, self.options.RemoveStaleUnixSocket)
+	if err != nil {
+		self.LogError(err)
+		return
+	}
 
-	for {
+	self.Log("unix: creating listener at", path)
+	listener, err := listenUnix(path, self.options.UnixSocketPermissions)
+	if err != nil {
+		self.LogError(err)
+		return
+	}
 
-		uuid_str := uuid.NewV4()
-		// if err != nil {
-		// 	self.Log("tcp: can't create new session id on new incomming connection:", err)
-		// 	time.Sleep(time.Second)
-		// 	continue
-		// }
+	self.Log("unix: listening at", path)
 
-		session_id := uuid_str.String()
+	if !self.addListener(listener) {
+		listener.Close()
+		return
+	}
 
-		newsession_options := &SessionOptions{
-			Server:    self,
-			SessionID: session_id,
+	defer func() {
+		self.removeListener(listener)
+		// this also removes socket file
+		listener.Close()
+	}()
+
+	set_working()
+
+	self.Log("unix: worker is working. entering main listening loop")
+
+	self.acceptLoop("unix "+path, TransportUnix, listener, false, is_stop_flag)
+
+	set_stopping()
+}
+
+// prepareUnixSocketPath checks what nothing prevents listening at path.
+// if remove_stale is true, socket file which is not listened by anyone is
+// removed
+func prepareUnixSocketPath(path string, remove_stale bool) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
 
-		newsession, err := NewSession(newsession_options)
-		if err != nil {
-			self.Log("tcp: error creating session:", err)
-			time.Sleep(time.Second)
-			continue
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and it is not a socket", path)
+	}
+
+	if !remove_stale {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is used by other process", path)
+	}
+
+	return os.Remove(path)
+}
+
+// listenUnix listens at unix socket path. if perm is not 0, socket is
+// created in private temporary directory next to path and moved to path
+// only after perm is set on it, so nobody can connect to socket having
+// default permissions
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if perm == 0 {
+		return net.Listen("unix", path)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".socket")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	tmp_path := filepath.Join(dir, "s")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp_path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// socket file is moved, so it's removed by unixListener.Close()
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp_path, perm)
+	if err == nil {
+		err = os.Rename(tmp_path, path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(tmp_path)
+		return nil, err
+	}
+
+	ret := &unixListener{
+		UnixListener: listener,
+		path:         path,
+		close_guard:  &sync.Once{},
+	}
+	return ret, nil
+}
+
+// unixListener removes socket file moved to path on Close()
+type unixListener struct {
+	*net.UnixListener
+	path        string
+	close_guard *sync.Once
+}
+
+func (self *unixListener) Close() error {
+	err := self.UnixListener.Close()
+	self.close_guard.Do(func() { os.Remove(self.path) })
+	return err
+}
+
+// acceptLoop accepts connections on listener and passes them to new
+// sessions. returns when listener is closed or stop is requested
+func (self *Server) acceptLoop(
+	name string,
+	transport string,
+	listener net.Listener,
+	use_tls bool,
+	is_stop_flag func() bool,
+) {
+
+	// poller must exit before acceptLoop returns: is_stop_flag can't be
+	// called after listening thread exited
+	done := make(chan struct{})
+	poller_exited := make(chan struct{})
+
+	defer func() {
+		close(done)
+		<-poller_exited
+	}()
+
+	go func() {
+		defer close(poller_exited)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			if is_stop_flag() || self.isShuttingDown() {
+				self.Log(name + ": listener got stop signal. exiting..")
+				listener.Close()
+				break
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
 		}
+	}()
+
+	for {
 
 		if is_stop_flag() {
 			break
 		}
 
-		newsession.Log("tcp: waiting for new connection")
+		self.LogDebug(name + ": waiting for new connection")
 		conn, err := listener.Accept()
 		if err != nil {
-			newsession.Log("tcp: listener connection accepting error:", err)
-			newsession.Destroy()
+			if is_stop_flag() || self.isShuttingDown() {
+				break
+			}
+			self.LogError(name+": listener connection accepting error:", err)
 			time.Sleep(time.Second)
 			continue
 		}
 
-		if self.options.EnableTLS {
-			tls_conn := tls.Server(conn, self.options.TLSConfig)
-			conn = tls_conn
-			newsession.Log("tcp: tls handshake")
-			err = tls_conn.Handshake()
-			if err != nil {
-				newsession.Log("tcp: tls handshake error:", err)
-			}
+		err = self.checkAcceptRate(conn.RemoteAddr().String())
+		if err != nil {
+			self.LogError(
+				name+": rejecting connection from",
+				conn.RemoteAddr().String(),
+				":",
+				err,
+			)
+			conn.Close()
+			continue
+		}
+
+		atomic.AddInt64(&self.accepting, 1)
+		go self.handleAcceptedConnection(name, transport, conn, use_tls)
+	}
+}
+
+// handleAcceptedConnection does TLS handshake (if use_tls), creates session
+// and passes connection to it. runs in own goroutine, so slow handshakes
+// don't block accepting of other connections. self.accepting must be
+// incremented by caller
+func (self *Server) handleAcceptedConnection(
+	name string,
+	transport string,
+	conn net.Conn,
+	use_tls bool,
+) {
+
+	accepted := true
+	done_accepting := func() {
+		if accepted {
+			accepted = false
+			atomic.AddInt64(&self.accepting, -1)
 		}
+	}
+	defer done_accepting()
 
-		newsession.Log(
-			"tcp: got new connection at",
-			conn.LocalAddr().String(),
-			"from",
+	var tls_state *tls.ConnectionState
+
+	err := self.checkSessionLimits(conn.RemoteAddr().String())
+	if err != nil {
+		self.LogError(
+			name+": rejecting connection from",
 			conn.RemoteAddr().String(),
+			":",
+			err,
 		)
+		conn.Close()
+		return
+	}
+
+	self.setTCPKeepAlive(conn)
+
+	if use_tls {
+		tls_conn := tls.Server(conn, self.tls_config)
+		conn = tls_conn
+
+		handshake_timeout := self.options.TLSHandshakeTimeout
+		if handshake_timeout == 0 {
+			handshake_timeout = DefaultTLSHandshakeTimeout
+		}
+
+		self.LogDebug(name+": tls handshake with", conn.RemoteAddr().String())
+		conn.SetDeadline(time.Now().Add(handshake_timeout))
+		err := tls_conn.Handshake()
+		if err != nil {
+			self.LogError(
+				name+": tls handshake with",
+				conn.RemoteAddr().String(),
+				"error:",
+				err,
+			)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
 
-		go func(s *Session, conn net.Conn) {
-			// defer s.Destroy() // connection handler will do it manually
-			s.Log("tcp: separated to own routine")
-			s.HandleConnection(conn)
-		}(newsession, conn)
+		state := tls_conn.ConnectionState()
+		tls_state = &state
 	}
 
-	set_stopping()
+	uuid_str := uuid.NewV4()
+	// if err != nil {
+	// 	self.Log("tcp: can't create new session id on new incomming connection:", err)
+	// 	time.Sleep(time.Second)
+	// 	continue
+	// }
+
+	session_id := uuid_str.String()
+
+	newsession_options := &SessionOptions{
+		Server:     self,
+		SessionID:  session_id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Transport:  transport,
+
+		TLSConnectionState: tls_state,
+	}
+
+	newsession, err := NewSession(newsession_options)
+	if err != nil {
+		self.LogError(name+": error creating session:", err)
+		conn.Close()
+		return
+	}
+
+	newsession.Log(
+		name+": got new connection at",
+		conn.LocalAddr().String(),
+		"from",
+		conn.RemoteAddr().String(),
+	)
+
+	done_accepting()
+
+	// connection handler will destroy session manually
+	newsession.HandleConnection(conn)
 }
 
 type MyHttpHandler struct {
@@ -226,22 +1089,40 @@ type MyHttpHandler struct {
 
 func (self *MyHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	self.server.Log("http: preparing new handler")
+	// hijacked connections aren't tracked by http.Server.Shutdown()
+	atomic.AddInt64(&self.server.accepting, 1)
+	defer atomic.AddInt64(&self.server.accepting, -1)
 
-	self.server.Log("http: preparing websocket")
+	self.server.LogDebug("http: preparing new handler")
 
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+	err := self.server.checkAcceptRate(r.RemoteAddr)
+	if err == nil {
+		err = self.server.checkSessionLimits(r.RemoteAddr)
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		self.server.LogError("http: rejecting connection from", r.RemoteAddr, ":", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	principal, authenticated, ok := self.server.authenticateHTTP(w, r)
+	if !ok {
 		return
 	}
 
-	self.server.Log("http: connecting object streamer")
+	self.server.LogDebug("http: preparing websocket")
+
+	conn, err := self.server.ws_upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		self.server.LogError("http: websocket upgrade error:", err)
+		return
+	}
+
+	if self.server.options.WSReadLimit > 0 {
+		conn.SetReadLimit(self.server.options.WSReadLimit)
+	}
+
+	self.server.LogDebug("http: connecting object streamer")
 
 	bs := jsonrpc2websocket.NewObjectStream(conn)
 
@@ -256,13 +1137,26 @@ func (self *MyHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	self.server.Log("http: new session id is:", session_id)
 
 	newsession_options := &SessionOptions{
-		Server:    self.server,
-		SessionID: session_id,
+		Server:     self.server,
+		SessionID:  session_id,
+		RemoteAddr: r.RemoteAddr,
+		Transport:  TransportWebSocket,
+
+		TLSConnectionState: r.TLS,
+
+		Principal:     principal,
+		Authenticated: authenticated,
 	}
 
 	newsession, err := NewSession(newsession_options)
 	if err != nil {
-		self.server.Log("http: error creating session:", err)
+		self.server.LogError("http: error creating session:", err)
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+			time.Now().Add(time.Second),
+		)
+		conn.Close()
 		return
 	}
 
@@ -273,14 +1167,18 @@ func (self *MyHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		conn.RemoteAddr().String(),
 	)
 
+	newsession.startWSKeepAlive(conn)
+
 	go func(s *Session, bs jsonrpc2.ObjectStream) {
 		// defer s.Destroy() // connection handler will do it manually
-		s.Log("http: separated to own routine")
+		s.LogDebug("http: separated to own routine")
 		s.HandleBS(bs)
 	}(newsession, bs)
 }
 
 func (self *Server) httpThread(
+	address string,
+
 	set_starting func(),
 	set_working func(),
 	set_stopping func(),
@@ -304,12 +1202,36 @@ func (self *Server) httpThread(
 
 	for {
 
+		if is_stop_flag() || self.isShuttingDown() {
+			break
+		}
+
 		mux_router := mux.NewRouter()
 
-		mux_router.Path("/socket").Handler(&MyHttpHandler{
+		mux_router.Path(self.wsPath()).Handler(&MyHttpHandler{
 			server: self,
 		})
 
+		if self.options.EnableHTTPPost {
+			http_post_path := self.options.HTTPPostPath
+			if http_post_path == "" {
+				http_post_path = DefaultHTTPPostPath
+			}
+			self.Log("http: serving JSON-RPC over HTTP POST at", http_post_path)
+			mux_router.Path(http_post_path).Handler(&HttpPostHandler{
+				server: self,
+			})
+		}
+
+		if self.options.Metrics != nil {
+			metrics_path := self.options.MetricsPath
+			if metrics_path == "" {
+				metrics_path = DefaultMetricsPath
+			}
+			self.Log("http: serving metrics at", metrics_path)
+			mux_router.Path(metrics_path).Handler(self.options.Metrics)
+		}
+
 		if self.options.HostStaticDir {
 			self.Log("configured static files hosting:")
 			self.Log("  path prefix: ", self.options.StaticDirURIPathPrefix)
@@ -328,39 +1250,43 @@ func (self *Server) httpThread(
 			)
 		}
 
-		self.Log("http: address is:", self.options.ListenAtAddressesWS)
+		self.Log("http: address is:", address)
+
+		// http post response is written after waiting for handlers up to
+		// HTTPPostTimeout, so write deadline must be later than that
+		write_timeout := self.httpPostTimeout() + 10*time.Second
 
 		s := &http.Server{
-			Addr:           self.options.ListenAtAddressesWS,
+			Addr:           address,
 			Handler:        mux_router,
 			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
+			WriteTimeout:   write_timeout,
 			MaxHeaderBytes: 1 << 20,
-			TLSConfig:      self.options.TLSConfig,
+			TLSConfig:      self.tls_config,
+		}
+
+		if !self.addHTTPServer(s) {
+			break
 		}
 
 		if self.options.EnableTLS {
 			self.Log("http: ListenAndServeTLS")
 			err = s.ListenAndServeTLS("", "")
-			if err != nil {
-				self.Log("http: ListenAndServeTLS: ", err)
-				time.Sleep(time.Second)
-				continue
-			}
 		} else {
+			self.Log("http: ListenAndServe")
 			err = s.ListenAndServe()
-			if err != nil {
-				self.Log("http: ListenAndServe")
-				self.Log("http: ListenAndServe: ", err)
-				time.Sleep(time.Second)
-				continue
-			}
 		}
 
-		if is_stop_flag() {
+		self.removeHTTPServer(s)
+
+		if is_stop_flag() || self.isShuttingDown() {
 			break
 		}
 
+		if err != nil {
+			self.LogError("http: ListenAndServe: ", err)
+			time.Sleep(time.Second)
+		}
 	}
 
 	set_stopping()
@@ -0,0 +1,648 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testAppSession struct {
+	handle func(ctx *RPCHandleContext)
+}
+
+func (self *testAppSession) RPCHandle(ctx *RPCHandleContext) {
+	if self.handle != nil {
+		self.handle(ctx)
+		return
+	}
+	if !ctx.Req.Notif {
+		ctx.Responder.Reply(1)
+	}
+}
+
+func (self *testAppSession) Destroy() {
+}
+
+func testFreeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func testWaitListening(t *testing.T, address string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server isn't listening on", address)
+}
+
+// testStartHTTPServer starts server with websocket and HTTP POST
+// transports on free port. handle can be nil - all requests are replied
+// with 1 then
+func testStartHTTPServer(
+	t *testing.T,
+	opts *ServerOptions,
+	handle func(ctx *RPCHandleContext),
+) (*Server, string) {
+	t.Helper()
+	return testStartHTTPServerWithApp(t, opts, &testAppSession{handle: handle})
+}
+
+// same as testStartHTTPServer, but app is used as AppContextSession of
+// every session
+func testStartHTTPServerWithApp(
+	t *testing.T,
+	opts *ServerOptions,
+	app AppContextSession,
+) (*Server, string) {
+	t.Helper()
+
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+
+	address := testFreeAddress(t)
+
+	opts.ListenAtAddressesWS = []string{address}
+	opts.EnableHTTPPost = true
+	if opts.Logger == nil {
+		opts.Logger = LogFunc(func(...interface{}) {})
+	}
+	opts.CreateAppContextSession = func(Destructable) (AppContextSession, error) {
+		return app, nil
+	}
+
+	server, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.GetWorker().Start()
+	t.Cleanup(server.Destroy)
+
+	testWaitListening(t, address)
+
+	return server, address
+}
+
+func testPost(t *testing.T, address string, body string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Post(
+		"http://"+address+DefaultHTTPPostPath,
+		"application/json",
+		bytes.NewBufferString(body),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b := &bytes.Buffer{}
+	b.ReadFrom(resp.Body)
+	return resp.StatusCode, b.String()
+}
+
+func testDialWS(t *testing.T, address string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+DefaultWSPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+type testWSResponse struct {
+	ID     int
+	Result interface{}
+	Error  *struct {
+		Code int64
+	}
+}
+
+func testReadWS(t *testing.T, conn *websocket.Conn) testWSResponse {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ret testWSResponse
+	err := conn.ReadJSON(&ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// testSlowServer starts server, which replies to "slow" method after
+// release is closed. started receives value when "slow" is called
+func testSlowServer(t *testing.T) (
+	server *Server,
+	address string,
+	started chan struct{},
+	release chan struct{},
+) {
+	t.Helper()
+
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+
+	server, address = testStartHTTPServer(
+		t,
+		&ServerOptions{
+			AsyncRequestHandling: true,
+		},
+		func(ctx *RPCHandleContext) {
+			if ctx.Req.Method == "slow" {
+				started <- struct{}{}
+				<-release
+			}
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	return
+}
+
+func TestShutdownWaitsForInFlightCalls(t *testing.T) {
+
+	server, address, started, release := testSlowServer(t)
+
+	conn := testDialWS(t, address)
+
+	err := conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shutdown_result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown_result <- server.Shutdown(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !server.isShuttingDown() {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown isn't started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// new calls are rejected while in-flight call is handled
+	err = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": 2, "method": "fast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testReadWS(t, conn)
+	if resp.ID != 2 || resp.Error == nil || resp.Error.Code != CodeServerShuttingDown {
+		t.Fatal("unexpected response to call made during shutdown:", resp)
+	}
+
+	close(release)
+
+	resp = testReadWS(t, conn)
+	if resp.ID != 1 || resp.Error != nil {
+		t.Fatal("in-flight call isn't finished:", resp)
+	}
+
+	select {
+	case err := <-shutdown_result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown isn't finished")
+	}
+
+	if server.SessionCount() != 0 {
+		t.Fatal("sessions aren't destroyed")
+	}
+}
+
+func TestShutdownDestroysSessionsWhenCtxExpires(t *testing.T) {
+
+	server, address, started, release := testSlowServer(t)
+	defer close(release)
+
+	conn := testDialWS(t, address)
+
+	err := conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("unexpected result of Shutdown:", err)
+	}
+
+	if server.SessionCount() != 0 {
+		t.Fatal("sessions aren't destroyed")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if err == nil {
+		t.Fatal("connection isn't closed")
+	}
+
+	// repeated Shutdown waits for first one
+	err = server.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+
+	server, address := testStartHTTPServer(t, nil, nil)
+
+	if server.SessionCount() != 0 || len(server.Sessions()) != 0 {
+		t.Fatal("unexpected sessions before connection")
+	}
+
+	conn1 := testDialWS(t, address)
+	conn2 := testDialWS(t, address)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SessionCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions aren't registered:", server.SessionCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 2 {
+		t.Fatal("unexpected number of sessions:", len(sessions))
+	}
+
+	for _, i := range sessions {
+		x, ok := server.SessionByID(i.GetSessionId())
+		if !ok || x != i {
+			t.Fatal("session isn't found by id")
+		}
+	}
+
+	if _, ok := server.SessionByID("unknown"); ok {
+		t.Fatal("unknown session is found")
+	}
+
+	// kicked session is removed
+	sessions[0].Destroy()
+
+	if _, ok := server.SessionByID(sessions[0].GetSessionId()); ok {
+		t.Fatal("destroyed session is still registered")
+	}
+	if server.SessionCount() != 1 {
+		t.Fatal("unexpected number of sessions:", server.SessionCount())
+	}
+
+	// session of closed connection is removed
+	conn1.Close()
+	conn2.Close()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for server.SessionCount() != 0 || len(server.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions of closed connections aren't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+
+	http_handling := make(chan struct{})
+	http_release := make(chan struct{})
+
+	server, address := testStartHTTPServer(
+		t,
+		nil,
+		func(ctx *RPCHandleContext) {
+			if ctx.Req.Method == "http" {
+				close(http_handling)
+				<-http_release
+			}
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	conn1 := testDialWS(t, address)
+	conn2 := testDialWS(t, address)
+
+	// HTTP POST session exists while request is handled
+	go http.Post(
+		"http://"+address+DefaultHTTPPostPath,
+		"application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"http"}`),
+	)
+	<-http_handling
+	defer close(http_release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SessionCount() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions aren't registered:", server.SessionCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	filtered := 0
+	server.Broadcast(
+		context.Background(),
+		"note",
+		"x",
+		func(s *Session) bool {
+			if s.GetTransport() == TransportHTTP {
+				t.Error("HTTP POST session is passed to filter")
+			}
+			filtered++
+			return true
+		},
+	)
+
+	if filtered != 2 {
+		t.Fatal("unexpected number of filtered sessions:", filtered)
+	}
+
+	for _, i := range []*websocket.Conn{conn1, conn2} {
+		var note struct {
+			Method string
+			Params string
+		}
+		i.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := i.ReadJSON(&note)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if note.Method != "note" || note.Params != "x" {
+			t.Fatal("unexpected notification:", note)
+		}
+	}
+}
+
+// Broadcast isn't blocked by client which doesn't read
+func TestBroadcastReturnsWhenCtxIsDone(t *testing.T) {
+
+	server, address := testStartHTTPServer(t, nil, nil)
+
+	testDialWS(t, address)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.SessionCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("session isn't registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// too big to fit into socket buffers
+	params := strings.Repeat("x", 64<<20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	server.Broadcast(ctx, "note", params, nil)
+
+	if x := time.Since(started); x > 2*time.Second {
+		t.Fatal("Broadcast isn't bounded by ctx:", x)
+	}
+}
+
+func testTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gojsonrpc2server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestUnixSocketPermissions(t *testing.T) {
+
+	dir := testTempDir(t)
+	path := filepath.Join(dir, "rpc.sock")
+
+	server, err := NewServer(
+		&ServerOptions{
+			ListenAtUnixSockets:   []string{path},
+			UnixSocketPermissions: 0600,
+			Logger:                LogFunc(func(...interface{}) {}),
+			CreateAppContextSession: func(Destructable) (AppContextSession, error) {
+				return &testAppSession{}, nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.GetWorker().Start()
+	t.Cleanup(server.Destroy)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server isn't listening on", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatal("unexpected socket mode:", fi.Mode())
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("temporary files are left:", len(files))
+	}
+
+	server.Destroy()
+
+	_, err = os.Lstat(path)
+	if !os.IsNotExist(err) {
+		t.Fatal("socket file isn't removed:", err)
+	}
+}
+
+func TestPrepareUnixSocketPath(t *testing.T) {
+
+	dir := testTempDir(t)
+
+	err := prepareUnixSocketPath(filepath.Join(dir, "none.sock"), true)
+	if err != nil {
+		t.Fatal("missing path is refused:", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = prepareUnixSocketPath(file, true)
+	if err == nil {
+		t.Fatal("path which isn't socket is accepted")
+	}
+	if _, err = os.Lstat(file); err != nil {
+		t.Fatal("file which isn't socket is removed:", err)
+	}
+
+	path := filepath.Join(dir, "rpc.sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetUnlinkOnClose(false)
+
+	err = prepareUnixSocketPath(path, true)
+	if err == nil {
+		t.Fatal("socket which is listened is accepted")
+	}
+
+	listener.Close()
+
+	err = prepareUnixSocketPath(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(path); err != nil {
+		t.Fatal("stale socket is removed without remove_stale:", err)
+	}
+
+	err = prepareUnixSocketPath(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatal("stale socket isn't removed:", err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+
+	calls := make(chan string, 100)
+
+	interceptor := func(name string) Interceptor {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx *RPCHandleContext) {
+				calls <- name + " " + ctx.Req.Method
+				if name == "second" && ctx.Req.Method == "blocked" {
+					ctx.Responder.ReplyWithError(NewError(1000, "blocked", nil))
+					return
+				}
+				next(ctx)
+				calls <- name + " done"
+			}
+		}
+	}
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			Interceptors: []Interceptor{interceptor("first"), interceptor("second")},
+			Authenticator: func(ctx *RPCHandleContext) (interface{}, error) {
+				return "user", nil
+			},
+		},
+		func(ctx *RPCHandleContext) {
+			calls <- "app " + ctx.Req.Method
+			ctx.Responder.Reply(1)
+		},
+	)
+
+	expect := func(expected ...string) {
+		t.Helper()
+		for _, i := range expected {
+			select {
+			case x := <-calls:
+				if x != i {
+					t.Fatal("expected", i, "got", x)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected", i, "got nothing")
+			}
+		}
+	}
+
+	// requests of unauthenticated session are passed to interceptors too
+	_, body := testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"a"}`)
+	if !strings.Contains(body, `"code":-32001`) {
+		t.Fatal("unexpected response:", body)
+	}
+	expect("first a", "second a", "second done", "first done")
+
+	_, body = testPost(t, address, `{"jsonrpc":"2.0","id":1,"method":"blocked"}`)
+	if !strings.Contains(body, `"code":1000`) {
+		t.Fatal("unexpected response:", body)
+	}
+	expect("first blocked", "second blocked", "first done")
+
+	_, body = testPost(
+		t,
+		address,
+		`[{"jsonrpc":"2.0","id":1,"method":"auth"},`+
+			`{"jsonrpc":"2.0","id":2,"method":"a"}]`,
+	)
+	if !strings.Contains(body, `"id":2,"result":1`) {
+		t.Fatal("unexpected response:", body)
+	}
+	expect(
+		"first auth", "second auth", "second done", "first done",
+		"first a", "second a", "app a", "second done", "first done",
+	)
+
+	select {
+	case x := <-calls:
+		t.Fatal("unexpected call:", x)
+	default:
+	}
+}
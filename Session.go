@@ -2,16 +2,46 @@ package gojsonrpc2server
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"net"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"time"
 
+	uuid "github.com/satori/go.uuid"
 	"github.com/sourcegraph/jsonrpc2"
 )
 
+var ErrSessionNotConnected = errors.New("session has no active rpc connection")
+
+// returned by Session.Notify() and Session.Call() for HTTP POST sessions:
+// HTTP client can't receive server initiated messages
+var ErrSessionTransportUnsupported = errors.New(
+	"session transport doesn't support server initiated messages",
+)
+
+const (
+	TransportTCP       = "tcp"
+	TransportUnix      = "unix"
+	TransportWebSocket = "websocket"
+	TransportHTTP      = "http"
+)
+
 type SessionOptions struct {
-	Server    *Server
-	SessionID string
+	Server     *Server
+	SessionID  string
+	RemoteAddr string
+	Transport  string
+
+	// set if session is authenticated on creation (see
+	// ServerOptions.HTTPAuthenticator)
+	Principal     interface{}
+	Authenticated bool
+
+	// nil if connection isn't TLS
+	TLSConnectionState *tls.ConnectionState
 }
 
 type Session struct {
@@ -22,10 +52,31 @@ type Session struct {
 	client_connection                net.Conn
 	client_connection_close_manually bool
 
-	jsonrpc2_conn *jsonrpc2.Conn
+	loggerHolder
+
+	jsonrpc2_conn       *jsonrpc2.Conn
+	jsonrpc2_conn_mutex *sync.RWMutex
 
 	app_context_session AppContextSession
 
+	principal     interface{}
+	authenticated bool
+	auth_timer    *time.Timer
+	auth_mutex    *sync.Mutex
+
+	destroyed      bool
+	destroyed_chan chan struct{}
+
+	// unix nanoseconds of last received or sent message. accessed
+	// atomically
+	last_activity int64
+	idle_timer    *time.Timer
+
+	// requests accepted by limitedHandler and not handled yet. accessed
+	// atomically
+	in_flight    int64
+	rate_limiter *rateLimiter
+
 	destroy_guard *sync.Once
 }
 
@@ -35,10 +86,34 @@ func NewSession(options *SessionOptions) (*Session, error) {
 		options:       options,
 		session_id:    options.SessionID,
 		destroy_guard: &sync.Once{},
+
+		destroyed_chan: make(chan struct{}),
+
+		rate_limiter: newRateLimiter(options.Server.options.SessionRateLimits),
+
+		jsonrpc2_conn_mutex: &sync.RWMutex{},
+
+		principal:     options.Principal,
+		authenticated: options.Authenticated,
+		auth_mutex:    &sync.Mutex{},
+	}
+
+	self.logger = WithFields(
+		self.options.Server.root_logger,
+		LogFieldComponent, "session",
+		LogFieldSessionID, self.session_id,
+		LogFieldTransport, self.options.Transport,
+		LogFieldRemoteAddr, self.options.RemoteAddr,
+	)
+
+	err := self.options.Server.registerSession(self)
+	if err != nil {
+		return nil, err
 	}
 
 	app_session, err := self.options.Server.options.CreateAppContextSession(self)
 	if err != nil {
+		self.options.Server.unregisterSession(self)
 		return nil, err
 	}
 
@@ -51,15 +126,110 @@ func (self *Session) GetSessionId() string {
 	return self.session_id
 }
 
-func (self *Session) Log(txt ...interface{}) {
-	t := []interface{}{fmt.Sprintf("[session %s]", self.session_id)}
-	t = append(t, txt...)
-	self.options.Server.Log(t...)
+func (self *Session) GetRemoteAddr() string {
+	return self.options.RemoteAddr
+}
+
+func (self *Session) GetTransport() string {
+	return self.options.Transport
+}
+
+func (self *Session) GetServer() *Server {
+	return self.options.Server
+}
+
+func (self *Session) getRPCConn() *jsonrpc2.Conn {
+	self.jsonrpc2_conn_mutex.RLock()
+	defer self.jsonrpc2_conn_mutex.RUnlock()
+	return self.jsonrpc2_conn
+}
+
+// Send notification to client
+func (self *Session) Notify(ctx context.Context, method string, params interface{}) error {
+	if self.options.Transport == TransportHTTP {
+		return ErrSessionTransportUnsupported
+	}
+	conn := self.getRPCConn()
+	if conn == nil {
+		return ErrSessionNotConnected
+	}
+	return conn.Notify(ctx, method, params)
+}
+
+// Call client's method and wait for result. if AsyncRequestHandling is
+// disabled, session reads next message only after handler of current one
+// returns, so Call made from handler of same session can't get reply and
+// blocks until ctx is done
+func (self *Session) Call(
+	ctx context.Context,
+	method string,
+	params interface{},
+	result interface{},
+) error {
+	if self.options.Transport == TransportHTTP {
+		return ErrSessionTransportUnsupported
+	}
+	conn := self.getRPCConn()
+	if conn == nil {
+		return ErrSessionNotConnected
+	}
+	return conn.Call(ctx, method, params, result)
 }
 
 func (self *Session) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 
-	session_context := &RPCHandleContext{
+	server := self.options.Server
+
+	metrics := server.options.Metrics
+
+	responder := NewHandleResponderWithLogger(
+		ctx,
+		conn,
+		req,
+		uuid.NewV4().String(),
+		self.logger,
+	)
+
+	// set when request is passed to handler
+	var session_context *RPCHandleContext
+
+	if metrics != nil {
+		started := time.Now()
+		defer func() {
+			routed := session_context != nil && session_context.routed
+			method := self.metricsMethod(req.Method, routed, responder)
+
+			metrics.CounterAdd(
+				MetricRequestsTotal,
+				"number of received requests and notifications",
+				1,
+				"method", method,
+				"transport", self.options.Transport,
+			)
+
+			metrics.HistogramObserve(
+				MetricRequestDuration,
+				"time spent in request handler",
+				nil,
+				time.Since(started).Seconds(),
+				"method", method,
+			)
+		}()
+	}
+
+	if server.isShuttingDown() {
+		if !req.Notif {
+			err := responder.ReplyWithError(
+				NewError(CodeServerShuttingDown, ErrServerShuttingDown.Error(), nil),
+			)
+			if err != nil {
+				responder.LogError("can't send error message to caller:", err)
+			}
+		}
+		return
+	}
+
+	session_context = &RPCHandleContext{
 		Ctx:     ctx,
 		Server:  self.options.Server,
 		Session: self,
@@ -67,23 +237,146 @@ func (self *Session) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonr
 		AppContextSession: self.app_context_session,
 		Conn:              conn,
 		Req:               req,
+		Responder:         responder,
 	}
 
-	self.app_context_session.RPCHandle(session_context)
+	defer func() {
+		x := recover()
+		if x != nil {
+			self.handlePanic(session_context, responder, x, debug.Stack())
+		}
+	}()
+
+	server.handler(session_context)
 
 	// TODO: cleanups?
 
 }
 
+// handleRouted is innermost handler of interceptors chain. it handles
+// AuthMethod requests and rejects requests of unauthenticated session.
+// other requests are passed to AppContextSession
+func (self *Session) handleRouted(ctx *RPCHandleContext) {
+
+	server := self.options.Server
+	req := ctx.Req
+
+	if server.authRequired() {
+		if server.options.Authenticator != nil &&
+			req.Method == server.authMethod() {
+			ctx.routed = true
+			self.handleAuth(ctx)
+			return
+		}
+
+		if !self.IsAuthenticated() {
+			if !req.Notif {
+				err := ctx.Responder.ReplyWithError(ErrUnauthorized(nil))
+				if err != nil {
+					ctx.Responder.LogError("can't send error message to caller:", err)
+				}
+			}
+			return
+		}
+	}
+
+	ctx.routed = true
+	ctx.AppContextSession.RPCHandle(ctx)
+}
+
+// handlePanic reports panic recovered from request handler and replies
+// with internal error if handler didn't reply yet. it must be called
+// before responder's Defer(), so caller doesn't get misleading "handler
+// didn't respond" error
+func (self *Session) handlePanic(
+	ctx *RPCHandleContext,
+	responder *HandleResponder,
+	x interface{},
+	stack []byte,
+) {
+	server := self.options.Server
+	req := ctx.Req
+
+	responder.GetLogger().Log(
+		LogLevelError,
+		logMessage("run time panic while handling", req.Method, ":", x),
+		"stack", string(stack),
+	)
+
+	server.options.Metrics.CounterAdd(
+		MetricPanicsTotal,
+		"number of panics in request handlers",
+		1,
+		"method", self.metricsMethod(req.Method, true, responder),
+	)
+
+	if server.options.PanicHandler != nil {
+		func() {
+			defer func() {
+				x := recover()
+				if x != nil {
+					responder.LogError("run time panic in PanicHandler:", x)
+				}
+			}()
+			server.options.PanicHandler(ctx, x, stack)
+		}()
+	}
+
+	if !req.Notif && !responder.Responded() {
+		err := responder.ReplyWithError(ErrInternalError(nil))
+		if err != nil {
+			responder.LogError("can't send error message to caller:", err)
+		}
+	}
+}
+
+// metricsMethod returns value of "method" label for request metrics.
+// methods unknown to AppContextSession are reported as MetricMethodOther,
+// so clients can't create unlimited number of series. if
+// AppContextSession doesn't implement HasMethod() (Router does), method
+// is considered unknown if request didn't reach handler or was replied
+// with "method not found" error
+func (self *Session) metricsMethod(
+	method string,
+	routed bool,
+	responder *HandleResponder,
+) string {
+	server := self.options.Server
+
+	if server.authRequired() &&
+		server.options.Authenticator != nil &&
+		method == server.authMethod() {
+		return method
+	}
+
+	if checker, ok := self.app_context_session.(methodChecker); ok {
+		if checker.HasMethod(method) {
+			return method
+		}
+		return MetricMethodOther
+	}
+
+	if routed && responder.error_code != CodeMethodNotFound {
+		return method
+	}
+
+	return MetricMethodOther
+}
+
 func (self *Session) HandleConnection(conn net.Conn) {
 
 	self.client_connection = conn
 	self.client_connection_close_manually = true
 
-	self.Log("creating buffered streamer")
+	codec := self.options.Server.options.TCPCodec
+	if codec == nil {
+		codec = jsonrpc2.VarintObjectCodec{}
+	}
+
+	self.LogDebug("creating buffered streamer")
 	buffered_object_stream := jsonrpc2.NewBufferedStream(
 		self.client_connection,
-		jsonrpc2.VarintObjectCodec{},
+		codec,
 	)
 
 	self.HandleBS(buffered_object_stream)
@@ -94,7 +387,7 @@ func (self *Session) HandleConnection(conn net.Conn) {
 func (self *Session) HandleBS(bs jsonrpc2.ObjectStream) {
 
 	defer func() {
-		self.Log("session handler exiting")
+		self.LogDebug("session handler exiting")
 		self.Destroy()
 	}()
 
@@ -102,23 +395,91 @@ func (self *Session) HandleBS(bs jsonrpc2.ObjectStream) {
 
 	ctx := context.Background()
 
-	self.Log("creating RPC connection")
+	self.LogDebug("creating RPC connection")
+
+	// requests received with http post are handled synchronously, as
+	// handler waits for all of them to be handled
+	handler := &limitedHandler{
+		session: self,
+		async: self.options.Server.options.AsyncRequestHandling &&
+			self.options.Transport != TransportHTTP,
+	}
+	if handler.async {
+		self.LogDebug("using Async handling")
+	}
 
-	handler := jsonrpc2.Handler(self)
+	var conn_opts []jsonrpc2.ConnOpt
+
+	if metrics := self.options.Server.options.Metrics; metrics != nil {
+		transport := self.options.Transport
+		conn_opts = append(
+			conn_opts,
+			jsonrpc2.OnSend(
+				func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+					if resp == nil {
+						return
+					}
+					var code int64
+					if resp.Error != nil {
+						code = resp.Error.Code
+					}
+					metrics.CounterAdd(
+						MetricResponsesTotal,
+						"number of sent responses by error code (0 is success)",
+						1,
+						"code", strconv.FormatInt(code, 10),
+						"transport", transport,
+					)
+				},
+			),
+		)
+	}
 
-	if self.options.Server.options.AsyncRequestHandling {
-		self.Log("using Async handling")
-		handler = jsonrpc2.AsyncHandler(handler)
+	use_idle_timeout := self.options.Server.options.SessionIdleTimeout > 0 &&
+		self.options.Transport != TransportHTTP
+
+	if use_idle_timeout {
+		conn_opts = append(
+			conn_opts,
+			jsonrpc2.OnRecv(
+				func(*jsonrpc2.Request, *jsonrpc2.Response) {
+					self.touchActivity()
+				},
+			),
+			jsonrpc2.OnSend(
+				func(*jsonrpc2.Request, *jsonrpc2.Response) {
+					self.touchActivity()
+				},
+			),
+		)
 	}
 
 	jsonrpc2_conn := jsonrpc2.NewConn(
 		ctx,
 		bs,
 		handler,
+		conn_opts...,
 	)
+	self.jsonrpc2_conn_mutex.Lock()
 	self.jsonrpc2_conn = jsonrpc2_conn
+	destroyed := self.destroyed
+	if !destroyed && use_idle_timeout {
+		self.startIdleTimer()
+	}
+	self.jsonrpc2_conn_mutex.Unlock()
+
+	if destroyed {
+		// Destroy() was called before connection was created
+		jsonrpc2_conn.Close()
+		return
+	}
+
+	if self.options.Server.authRequired() &&
+		self.options.Transport != TransportHTTP {
+		self.startAuthTimer()
+	}
 
-	self.Log("RPC is working. now waiting for quit signals")
+	self.LogDebug("RPC is working. now waiting for quit signals")
 	select {
 	case <-ctx.Done():
 		self.Log("got session termination signal using context")
@@ -133,27 +494,41 @@ func (self *Session) Destroy() {
 	self.destroy_guard.Do(
 		func() {
 
-			self.Log("destroy called")
+			self.LogDebug("destroy called")
 
-			if self.jsonrpc2_conn != nil {
-				self.Log("stopping RPC connection")
-				self.jsonrpc2_conn.Close()
+			self.stopAuthTimer()
+
+			self.jsonrpc2_conn_mutex.Lock()
+			self.destroyed = true
+			close(self.destroyed_chan)
+			if self.idle_timer != nil {
+				self.idle_timer.Stop()
+			}
+			self.jsonrpc2_conn_mutex.Unlock()
+
+			jsonrpc2_conn := self.getRPCConn()
+			if jsonrpc2_conn != nil {
+				self.LogDebug("stopping RPC connection")
+				jsonrpc2_conn.Close()
 				// self.jsonrpc2_conn = nil
 			}
 
 			if self.client_connection_close_manually {
 				if self.client_connection != nil {
 					// TODO: maybe additionnaly signalling to client would be not bad
-					self.Log("closing socket connection manually")
+					self.LogDebug("closing socket connection manually")
 					self.client_connection.Close()
 					// self.client_connection = nil
 				}
 			}
 
 			if self.app_context_session != nil {
-				self.Log("asking context session to kill self")
+				self.LogDebug("asking context session to kill self")
 				self.app_context_session.Destroy()
 			}
+
+			self.options.Server.unregisterSession(self)
+
 			self.Log("session destroyed")
 		},
 	)
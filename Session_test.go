@@ -0,0 +1,76 @@
+package gojsonrpc2server
+
+import (
+	"testing"
+)
+
+func TestSessionNotifyAndCall(t *testing.T) {
+
+	_, address := testStartHTTPServer(
+		t,
+		&ServerOptions{
+			AsyncRequestHandling: true,
+		},
+		func(ctx *RPCHandleContext) {
+			err := ctx.Session.Notify(ctx.Ctx, "note", "x")
+			if err != nil {
+				ctx.Responder.ReplyWithError(ErrInternalError(err.Error()))
+				return
+			}
+
+			var res int
+			err = ctx.Session.Call(ctx.Ctx, "double", 5, &res)
+			if err != nil {
+				ctx.Responder.ReplyWithError(ErrInternalError(err.Error()))
+				return
+			}
+			ctx.Responder.Reply(res)
+		},
+	)
+
+	conn := testDialWS(t, address)
+
+	err := conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var note struct {
+		ID     *int
+		Method string
+		Params string
+	}
+	err = conn.ReadJSON(&note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.ID != nil || note.Method != "note" || note.Params != "x" {
+		t.Fatal("unexpected notification:", note)
+	}
+
+	var call struct {
+		ID     interface{}
+		Method string
+		Params int
+	}
+	err = conn.ReadJSON(&call)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.ID == nil || call.Method != "double" {
+		t.Fatal("unexpected call:", call)
+	}
+
+	err = conn.WriteJSON(
+		map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "result": call.Params * 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testReadWS(t, conn)
+	if resp.ID != 1 || resp.Result != float64(10) {
+		t.Fatal("unexpected response:", resp)
+	}
+
+}
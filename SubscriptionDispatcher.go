@@ -0,0 +1,359 @@
+package gojsonrpc2server
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+const (
+	DefaultDispatchWorkers   = 16
+	DefaultDispatchQueueSize = 100
+)
+
+// DispatchOverflowPolicy defines what happens when subscriber's queue is
+// full
+type DispatchOverflowPolicy int
+
+const (
+	// oldest queued message of subscriber is dropped
+	DispatchDropOldest DispatchOverflowPolicy = iota
+	// upstream connection handler waits until there is space in queue.
+	// one slow subscriber slows down all subscribers of descriptor
+	DispatchBlock
+	// subscriber is unsubscribed, it's queue is dropped and
+	// SubscriptionMgrOptions.SlowSubscriberHandler is called
+	DispatchDisconnect
+)
+
+func (self DispatchOverflowPolicy) String() string {
+	switch self {
+	case DispatchDropOldest:
+		return "drop_oldest"
+	case DispatchBlock:
+		return "block"
+	case DispatchDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+type dispatchItem struct {
+	request  *jsonrpc2.Request
+	uuid_str string
+}
+
+// subscriberQueue holds messages of one subscriber of one descriptor. it's
+// handled by one worker at a time, so messages are passed to RespHandler in
+// order they are received
+type subscriberQueue struct {
+	descriptor               string
+	unsubscribing_descriptor string
+
+	items []dispatchItem
+
+	// true if queue is in ready list or is being handled by worker
+	scheduled bool
+	// true if queue is dropped by DispatchDisconnect policy
+	removed bool
+}
+
+type subscriptionDispatchKey struct {
+	descriptor               string
+	unsubscribing_descriptor string
+}
+
+// subscriptionDispatcher passes messages received from upstream to
+// RespHandler using fixed number of workers
+type subscriptionDispatcher struct {
+	mgr *SubscriptionMgr
+
+	queue_size int
+	policy     DispatchOverflowPolicy
+
+	queues map[subscriptionDispatchKey]*subscriberQueue
+	ready  []*subscriberQueue
+
+	// set by stop(). workers exit and new messages are ignored
+	stopped bool
+
+	mutex      *sync.Mutex
+	ready_cond *sync.Cond
+	space_cond *sync.Cond
+}
+
+func newSubscriptionDispatcher(mgr *SubscriptionMgr) *subscriptionDispatcher {
+
+	workers := mgr.options.DispatchWorkers
+	if workers <= 0 {
+		workers = DefaultDispatchWorkers
+	}
+
+	queue_size := mgr.options.DispatchQueueSize
+	if queue_size <= 0 {
+		queue_size = DefaultDispatchQueueSize
+	}
+
+	self := &subscriptionDispatcher{
+		mgr:        mgr,
+		queue_size: queue_size,
+		policy:     mgr.options.DispatchOverflowPolicy,
+		queues:     make(map[subscriptionDispatchKey]*subscriberQueue),
+		mutex:      &sync.Mutex{},
+	}
+	self.ready_cond = sync.NewCond(self.mutex)
+	self.space_cond = sync.NewCond(self.mutex)
+
+	for i := 0; i < workers; i++ {
+		go self.worker()
+	}
+
+	return self
+}
+
+// dispatch queues request for subscriber. with DispatchBlock policy it can
+// block until subscriber's queue has free space
+func (self *subscriptionDispatcher) dispatch(
+	mgr_sess *SubscriptionMgrSession,
+	unsubscribing_descriptor string,
+	request *jsonrpc2.Request,
+	uuid_str string,
+) {
+	metrics := self.mgr.options.Metrics
+
+	descriptor := mgr_sess.descriptor
+
+	key := subscriptionDispatchKey{descriptor, unsubscribing_descriptor}
+
+	self.mutex.Lock()
+
+	if self.stopped {
+		self.mutex.Unlock()
+		return
+	}
+
+	q, ok := self.queues[key]
+	if !ok {
+		q = &subscriberQueue{
+			descriptor:               descriptor,
+			unsubscribing_descriptor: unsubscribing_descriptor,
+		}
+		self.queues[key] = q
+	}
+
+	for len(q.items) >= self.queue_size {
+
+		switch self.policy {
+		case DispatchBlock:
+			self.space_cond.Wait()
+			if q.removed || self.stopped {
+				self.mutex.Unlock()
+				return
+			}
+			continue
+
+		case DispatchDisconnect:
+			dropped := len(q.items)
+			q.items = nil
+			q.removed = true
+			delete(self.queues, key)
+			self.mutex.Unlock()
+
+			metrics.CounterAdd(
+				MetricSubscriptionMgrDispatchDropped,
+				"number of messages dropped because of slow subscribers",
+				float64(dropped+1),
+				"manager", self.mgr.options.Name,
+				"policy", self.policy.String(),
+			)
+			metrics.GaugeAdd(
+				MetricSubscriptionMgrDispatchQueued,
+				"number of messages waiting to be passed to RespHandler",
+				-float64(dropped),
+				"manager", self.mgr.options.Name,
+			)
+
+			// removed here, so following messages are not dispatched to
+			// subscriber. Unsubscribe() can't be called here, as
+			// SubscriptionMgr can be locked
+			mgr_sess.removeSubscriber(unsubscribing_descriptor)
+			go self.mgr.disconnectSlowSubscriber(descriptor, unsubscribing_descriptor)
+			return
+
+		default:
+			q.items[0] = dispatchItem{}
+			q.items = q.items[1:]
+
+			metrics.CounterAdd(
+				MetricSubscriptionMgrDispatchDropped,
+				"number of messages dropped because of slow subscribers",
+				1,
+				"manager", self.mgr.options.Name,
+				"policy", self.policy.String(),
+			)
+			metrics.GaugeAdd(
+				MetricSubscriptionMgrDispatchQueued,
+				"number of messages waiting to be passed to RespHandler",
+				-1,
+				"manager", self.mgr.options.Name,
+			)
+		}
+	}
+
+	q.items = append(q.items, dispatchItem{request: request, uuid_str: uuid_str})
+
+	if !q.scheduled {
+		q.scheduled = true
+		self.ready = append(self.ready, q)
+		self.ready_cond.Signal()
+	}
+
+	self.mutex.Unlock()
+
+	metrics.GaugeAdd(
+		MetricSubscriptionMgrDispatchQueued,
+		"number of messages waiting to be passed to RespHandler",
+		1,
+		"manager", self.mgr.options.Name,
+	)
+}
+
+func (self *subscriptionDispatcher) worker() {
+	for {
+		self.mutex.Lock()
+
+		for len(self.ready) == 0 && !self.stopped {
+			self.ready_cond.Wait()
+		}
+
+		if self.stopped {
+			self.mutex.Unlock()
+			return
+		}
+
+		q := self.ready[0]
+		self.ready[0] = nil
+		self.ready = self.ready[1:]
+
+		if q.removed || len(q.items) == 0 {
+			q.scheduled = false
+			self.mutex.Unlock()
+			continue
+		}
+
+		item := q.items[0]
+		q.items[0] = dispatchItem{}
+		q.items = q.items[1:]
+
+		self.space_cond.Broadcast()
+
+		self.mutex.Unlock()
+
+		self.mgr.options.Metrics.GaugeAdd(
+			MetricSubscriptionMgrDispatchQueued,
+			"number of messages waiting to be passed to RespHandler",
+			-1,
+			"manager", self.mgr.options.Name,
+		)
+
+		self.call(q, item)
+
+		self.mutex.Lock()
+		// queue goes to the end of ready list, so subscribers with many
+		// messages don't hold workers forever
+		if !q.removed && len(q.items) != 0 {
+			self.ready = append(self.ready, q)
+			self.ready_cond.Signal()
+		} else {
+			q.scheduled = false
+			key := subscriptionDispatchKey{q.descriptor, q.unsubscribing_descriptor}
+			if x, ok := self.queues[key]; ok && x == q {
+				delete(self.queues, key)
+			}
+		}
+		self.mutex.Unlock()
+	}
+}
+
+func (self *subscriptionDispatcher) call(q *subscriberQueue, item dispatchItem) {
+	defer func() {
+		if x := recover(); x != nil {
+			self.mgr.logger.Log(
+				LogLevelError,
+				logMessage("RespHandler panic:", x),
+				LogFieldDescriptor, q.descriptor,
+				"stack", string(debug.Stack()),
+			)
+		}
+	}()
+
+	self.mgr.options.RespHandler(
+		q.descriptor,
+		q.unsubscribing_descriptor,
+		item.request,
+		item.uuid_str,
+	)
+}
+
+// drop removes queue of subscriber (if any). blocked dispatch() calls for
+// it return
+func (self *subscriptionDispatcher) drop(
+	descriptor string,
+	unsubscribing_descriptor string,
+) {
+	key := subscriptionDispatchKey{descriptor, unsubscribing_descriptor}
+
+	self.mutex.Lock()
+	q, ok := self.queues[key]
+	if !ok {
+		self.mutex.Unlock()
+		return
+	}
+	dropped := len(q.items)
+	q.items = nil
+	q.removed = true
+	delete(self.queues, key)
+	self.space_cond.Broadcast()
+	self.mutex.Unlock()
+
+	self.mgr.options.Metrics.GaugeAdd(
+		MetricSubscriptionMgrDispatchQueued,
+		"number of messages waiting to be passed to RespHandler",
+		-float64(dropped),
+		"manager", self.mgr.options.Name,
+	)
+}
+
+// stop drops all queued messages and stops workers. messages being passed
+// to RespHandler at the moment are not interrupted. blocked dispatch()
+// calls return
+func (self *subscriptionDispatcher) stop() {
+	self.mutex.Lock()
+	if self.stopped {
+		self.mutex.Unlock()
+		return
+	}
+	self.stopped = true
+
+	dropped := 0
+	for k, q := range self.queues {
+		dropped += len(q.items)
+		q.items = nil
+		q.removed = true
+		delete(self.queues, k)
+	}
+	self.ready = nil
+
+	self.ready_cond.Broadcast()
+	self.space_cond.Broadcast()
+	self.mutex.Unlock()
+
+	self.mgr.options.Metrics.GaugeAdd(
+		MetricSubscriptionMgrDispatchQueued,
+		"number of messages waiting to be passed to RespHandler",
+		-float64(dropped),
+		"manager", self.mgr.options.Name,
+	)
+}
@@ -0,0 +1,251 @@
+package gojsonrpc2server
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// testDispatcher makes SubscriptionMgr without upstream and session of
+// descriptor "d" with subscriber "s". RespHandler passes methods of
+// received requests to returned channel. it's blocked until release is
+// closed
+func testDispatcher(
+	t *testing.T,
+	options *SubscriptionMgrOptions,
+) (
+	mgr *SubscriptionMgr,
+	mgr_sess *SubscriptionMgrSession,
+	received chan string,
+	release chan struct{},
+) {
+	t.Helper()
+
+	received = make(chan string, 100)
+	release = make(chan struct{})
+
+	options.Logger = LogFunc(func(...interface{}) {})
+	options.GetDescriptorForParameter = func(parameter interface{}) string {
+		return parameter.(string)
+	}
+	options.RespHandler = func(
+		descriptor string,
+		unsubscribing_descriptor string,
+		request *jsonrpc2.Request,
+		uuid_str string,
+	) {
+		received <- request.Method
+		<-release
+	}
+
+	mgr, err := NewSubscriptionMgr(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mgr.Close)
+
+	mgr_sess = &SubscriptionMgrSession{
+		mgr:                             mgr,
+		descriptor:                      "d",
+		unsubscribing_descriptors:       []string{"s"},
+		unsubscribing_descriptors_mutex: &sync.Mutex{},
+		destroy_guard:                   &sync.Once{},
+	}
+
+	return
+}
+
+func testDispatch(mgr_sess *SubscriptionMgrSession, method string) {
+	mgr_sess.mgr.dispatcher.dispatch(
+		mgr_sess,
+		"s",
+		&jsonrpc2.Request{Method: method},
+		method,
+	)
+}
+
+func testReceive(t *testing.T, received chan string, expected ...string) {
+	t.Helper()
+
+	for _, i := range expected {
+		select {
+		case method := <-received:
+			if method != i {
+				t.Fatal("expected", i, "received", method)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message", i, "isn't received")
+		}
+	}
+
+	select {
+	case method := <-received:
+		t.Fatal("unexpected message", method)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatcherDropOldest(t *testing.T) {
+
+	metrics := NewMetrics("test")
+
+	_, mgr_sess, received, release := testDispatcher(
+		t,
+		&SubscriptionMgrOptions{
+			DispatchWorkers:   2,
+			DispatchQueueSize: 2,
+			Metrics:           metrics,
+		},
+	)
+
+	testDispatch(mgr_sess, "0")
+	testReceive(t, received, "0")
+
+	// worker is busy with "0", so "1" and "2" are dropped
+	for _, i := range []string{"1", "2", "3", "4"} {
+		testDispatch(mgr_sess, i)
+	}
+
+	close(release)
+
+	testReceive(t, received, "3", "4")
+
+	b := &bytes.Buffer{}
+	metrics.WritePrometheus(b)
+	out := b.String()
+
+	expected := `test_subscriptionmgr_dispatch_dropped_total{manager="",policy="drop_oldest"} 2`
+	if !strings.Contains(out, expected) {
+		t.Fatal("metrics don't contain", expected, ":\n", out)
+	}
+}
+
+func TestDispatcherBlock(t *testing.T) {
+
+	_, mgr_sess, received, release := testDispatcher(
+		t,
+		&SubscriptionMgrOptions{
+			DispatchQueueSize:      1,
+			DispatchOverflowPolicy: DispatchBlock,
+		},
+	)
+
+	testDispatch(mgr_sess, "0")
+	testReceive(t, received, "0")
+	testDispatch(mgr_sess, "1")
+
+	dispatched := make(chan struct{})
+	go func() {
+		testDispatch(mgr_sess, "2")
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch isn't blocked by full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	testReceive(t, received, "1", "2")
+	<-dispatched
+}
+
+func TestDispatcherBlockedDispatchReturnsOnClose(t *testing.T) {
+
+	mgr, mgr_sess, received, release := testDispatcher(
+		t,
+		&SubscriptionMgrOptions{
+			DispatchQueueSize:      1,
+			DispatchOverflowPolicy: DispatchBlock,
+		},
+	)
+	defer close(release)
+
+	testDispatch(mgr_sess, "0")
+	testReceive(t, received, "0")
+	testDispatch(mgr_sess, "1")
+
+	dispatched := make(chan struct{})
+	go func() {
+		testDispatch(mgr_sess, "2")
+		close(dispatched)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	mgr.Close()
+
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch is still blocked after Close")
+	}
+}
+
+func TestDispatcherDisconnect(t *testing.T) {
+
+	slow := make(chan string, 1)
+
+	_, mgr_sess, received, release := testDispatcher(
+		t,
+		&SubscriptionMgrOptions{
+			DispatchQueueSize:      1,
+			DispatchOverflowPolicy: DispatchDisconnect,
+			SlowSubscriberHandler: func(descriptor string, unsubscribing_descriptor string) {
+				slow <- descriptor + "/" + unsubscribing_descriptor
+			},
+		},
+	)
+
+	testDispatch(mgr_sess, "0")
+	testReceive(t, received, "0")
+	testDispatch(mgr_sess, "1")
+	testDispatch(mgr_sess, "2")
+
+	select {
+	case x := <-slow:
+		if x != "d/s" {
+			t.Fatal("unexpected subscriber disconnected:", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SlowSubscriberHandler isn't called")
+	}
+
+	if len(mgr_sess.subscribers()) != 0 {
+		t.Fatal("slow subscriber isn't removed")
+	}
+
+	close(release)
+
+	// queued "1" is dropped with subscriber
+	testReceive(t, received)
+}
+
+func TestDispatcherClose(t *testing.T) {
+
+	mgr, mgr_sess, received, release := testDispatcher(
+		t,
+		&SubscriptionMgrOptions{},
+	)
+
+	close(release)
+
+	testDispatch(mgr_sess, "0")
+	testReceive(t, received, "0")
+
+	mgr.Close()
+
+	testDispatch(mgr_sess, "1")
+	testReceive(t, received)
+
+	_, _, err := mgr.Subscribe(context.Background(), "x")
+	if err != ErrSubscriptionMgrClosed {
+		t.Fatal("unexpected error:", err)
+	}
+}
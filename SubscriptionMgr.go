@@ -2,27 +2,47 @@ package gojsonrpc2server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sourcegraph/jsonrpc2"
 )
 
+var ErrSubscriptionMgrClosed = errors.New("SubscriptionMgr is closed")
+
 type SubscriptionMgrSession struct {
 	mgr                       *SubscriptionMgr
 	descriptor                string
+	parameters                interface{}
 	unsubscribing_descriptors []string
-
-	jsonrpc2_conn        *jsonrpc2.Conn
-	jsonrpc2_conn_cancel context.CancelFunc
+	// changes of unsubscribing_descriptors are done with both this and
+	// SubscriptionMgr's mutex locked, so Handle() doesn't need to lock
+	// SubscriptionMgr (which can be locked while subscribing)
+	unsubscribing_descriptors_mutex *sync.Mutex
+
+	upstream *subscriptionUpstream
+	// protected by upstream's mutex. subscribing is true while
+	// RemoteSubscribeCommand is called by Subscribe(). subscribed_conn is
+	// connection on which descriptor was subscribed last time. both are
+	// used, so descriptor isn't subscribed twice on same connection
+	subscribing     bool
+	subscribed_conn *jsonrpc2.Conn
+
+	// result of RemoteSubscribeCommand
+	subscribe_result       json.RawMessage
+	subscribe_result_mutex *sync.Mutex
 
 	destroy_guard *sync.Once
 }
 
+// ctx limits time of connecting and waiting for reconnecting upstream
 func NewSubscriptionMgrSession(
+	ctx context.Context,
 	mgr *SubscriptionMgr,
 	descriptor string,
 	parameters interface{},
@@ -31,74 +51,57 @@ func NewSubscriptionMgrSession(
 	self := &SubscriptionMgrSession{
 		mgr:           mgr,
 		descriptor:    descriptor,
+		parameters:    parameters,
 		destroy_guard: &sync.Once{},
-	}
-
-	conn, err := self.mgr.options.GetNewConnection()
-
-	// tcp, err := net.Dial("tcp", self.mgr.options.Context.options.CmdLineOptions.ServerInternal)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// if self.mgr.options.Context.options.ServerOptions.EnableTLS {
-	// 	tcp = tls.Client(tcp, self.mgr.options.Context.options.ServerOptions.TLSConfig)
-	// }
-
-	bs := jsonrpc2.NewBufferedStream(conn, &jsonrpc2.VarintObjectCodec{})
-
-	ctx, jsonrpc2_conn_cancel := context.WithCancel(context.Background())
-	self.jsonrpc2_conn_cancel = jsonrpc2_conn_cancel
 
-	h := jsonrpc2.Handler(self)
-
-	if self.mgr.options.UseAsyncHandler {
-		h = jsonrpc2.AsyncHandler(h)
+		unsubscribing_descriptors_mutex: &sync.Mutex{},
+		subscribe_result_mutex:          &sync.Mutex{},
 	}
 
-	jsonrpc2_conn := jsonrpc2.NewConn(ctx, bs, h)
-
-	self.jsonrpc2_conn = jsonrpc2_conn
-
-	if self.mgr.options.Authenticator != nil {
-		err = self.mgr.options.Authenticator(jsonrpc2_conn)
-		if err != nil {
-			self.mgr.Log("  authentication error:", err)
-			return nil, err
-		}
+	upstream, err := mgr.getUpstream(ctx)
+	if err != nil {
+		return nil, err
 	}
+	self.upstream = upstream
 
-	var res interface{}
-	// self.mgr.Log("calling server for subscription. param: ", parameters)
-	err = jsonrpc2_conn.Call(ctx, self.mgr.options.RemoteSubscribeCommand, parameters, &res)
+	err = upstream.subscribe(ctx, self)
 	if err != nil {
-		self.mgr.Log("  error calling server for subscription:", err)
 		return nil, err
 	}
 
-	self.mgr.Log("  ok")
+	return self, nil
+}
 
-	go func() {
-		select {
-		case <-ctx.Done():
-		case <-jsonrpc2_conn.DisconnectNotify():
-		}
-		self.Destroy()
-	}()
+func (self *SubscriptionMgrSession) setSubscribeResult(result json.RawMessage) {
+	self.subscribe_result_mutex.Lock()
+	defer self.subscribe_result_mutex.Unlock()
 
-	return self, nil
+	self.subscribe_result = result
 }
 
-func (self *SubscriptionMgrSession) Destroy() {
+func (self *SubscriptionMgrSession) getSubscribeResult() json.RawMessage {
+	self.subscribe_result_mutex.Lock()
+	defer self.subscribe_result_mutex.Unlock()
+
+	return self.subscribe_result
+}
+
+// unsubscribeRemote calls RemoteUnsubscribeCommand (if set) and destroys
+// session
+func (self *SubscriptionMgrSession) unsubscribeRemote() {
 	self.destroy_guard.Do(
 		func() {
-			if self.jsonrpc2_conn_cancel != nil {
-				self.jsonrpc2_conn_cancel()
-			}
+			self.upstream.unsubscribe(self)
+		},
+	)
+}
 
-			if self.jsonrpc2_conn != nil {
-				self.jsonrpc2_conn.Close()
-			}
+// Destroy detaches session from upstream without unsubscribing.
+// dedicated upstream connection is closed
+func (self *SubscriptionMgrSession) Destroy() {
+	self.destroy_guard.Do(
+		func() {
+			self.upstream.detach(self)
 		},
 	)
 }
@@ -116,24 +119,45 @@ func (self *SubscriptionMgrSession) Handle(ctx context.Context, conn *jsonrpc2.C
 		uuid_o_s = uuid_o.String()
 	}
 
-	responder := NewHandleResponder(
+	responder := NewHandleResponderWithLogger(
 		ctx,
 		conn,
 		req,
 		uuid_o_s,
-		log.Println, // TODO: get better logger
+		WithFields(self.mgr.logger, LogFieldDescriptor, self.descriptor),
 	)
 
 	defer responder.Defer()
 
-	for _, i := range self.unsubscribing_descriptors {
-		// TODO: possible place for optimization
-		go self.mgr.options.RespHandler(self.descriptor, i, req, uuid_o_s)
+	for _, i := range self.subscribers() {
+		self.mgr.dispatcher.dispatch(self, i, req, uuid_o_s)
 	}
 	responder.Reply("ok")
 
 }
 
+// returns copy of unsubscribing_descriptors
+func (self *SubscriptionMgrSession) subscribers() []string {
+	self.unsubscribing_descriptors_mutex.Lock()
+	defer self.unsubscribing_descriptors_mutex.Unlock()
+
+	ret := make([]string, len(self.unsubscribing_descriptors))
+	copy(ret, self.unsubscribing_descriptors)
+	return ret
+}
+
+func (self *SubscriptionMgrSession) removeSubscriber(unsubscribing_descriptor string) {
+	self.unsubscribing_descriptors_mutex.Lock()
+	defer self.unsubscribing_descriptors_mutex.Unlock()
+
+	for i := len(self.unsubscribing_descriptors) - 1; i != -1; i -= 1 {
+		session := self.unsubscribing_descriptors[i]
+		if session == unsubscribing_descriptor {
+			self.unsubscribing_descriptors = append(self.unsubscribing_descriptors[:i], self.unsubscribing_descriptors[i+1:]...)
+		}
+	}
+}
+
 type SubscriptionMgrOptions struct {
 	// Context          *Context
 	UseAsyncHandler  bool
@@ -142,11 +166,82 @@ type SubscriptionMgrOptions struct {
 	// RemoteSubscribtionsCommand string // TODO: really needed?
 	RemoteSubscribeCommand string
 
-	// TODO: really needed? since Unsubscribe may anly me needed when
-	//       session's unsubscribing_descriptors length is 0, which already
-	//       leads to disconnect from server (and assumes automatic
-	//       unsubscribtion by server)
-	// RemoteUnsubscribeCommand string
+	// if set, it's called when descriptor's last subscriber unsubscribes,
+	// before connection is closed (else server is assumed to unsubscribe
+	// automatically on disconnect). parameter of call is returned by
+	// GetRemoteUnsubscribeParameter, which receives parameter and result
+	// of RemoteSubscribeCommand call. if GetRemoteUnsubscribeParameter is
+	// nil, parameter of RemoteSubscribeCommand is used.
+	// RemoteUnsubscribeTimeout defaults to DefaultRemoteUnsubscribeTimeout
+	RemoteUnsubscribeCommand      string
+	GetRemoteUnsubscribeParameter func(
+		subscribe_parameter interface{},
+		subscribe_result json.RawMessage,
+	) interface{}
+	RemoteUnsubscribeTimeout time.Duration
+
+	// limits time of making remote subscription (connecting to upstream,
+	// waiting for it to reconnect and RemoteSubscribeCommand call). it's
+	// made in background, so it's not limited by ctx of Subscribe().
+	// default is DefaultSubscribeTimeout
+	SubscribeTimeout time.Duration
+
+	// framing used on connections. nil means jsonrpc2.VarintObjectCodec
+	Codec jsonrpc2.ObjectCodec
+
+	// if nil, StdLogger is used
+	Logger Logger
+
+	// if not nil, number of descriptors and subscribers are recorded here.
+	// all metrics have "manager" label set to Name, so managers sharing
+	// Metrics must have different names. Name can be empty if only one
+	// manager is using Metrics
+	Metrics *Metrics
+	Name    string
+
+	// messages from upstream are passed to RespHandler by DispatchWorkers
+	// goroutines (default is DefaultDispatchWorkers). each subscriber has
+	// own queue of DispatchQueueSize messages (default is
+	// DefaultDispatchQueueSize), messages of one subscriber are passed in
+	// order they are received. DispatchOverflowPolicy defines what to do
+	// when subscriber's queue is full
+	DispatchWorkers        int
+	DispatchQueueSize      int
+	DispatchOverflowPolicy DispatchOverflowPolicy
+
+	// called when subscriber is unsubscribed by DispatchDisconnect
+	// policy. can be nil
+	SlowSubscriberHandler func(descriptor string, unsubscribing_descriptor string)
+
+	// lost upstream connections are reestablished (with Authenticator and
+	// RemoteSubscribeCommand called again) with delays growing from
+	// ReconnectMinDelay to ReconnectMaxDelay (defaults are
+	// DefaultReconnectMinDelay and DefaultReconnectMaxDelay). after
+	// ReconnectMaxAttempts failed attempts (0 means no limit) or if
+	// DisableReconnect is true, descriptor is removed with all it's
+	// subscribers
+	DisableReconnect     bool
+	ReconnectMinDelay    time.Duration
+	ReconnectMaxDelay    time.Duration
+	ReconnectMaxAttempts int
+
+	// called when messages of descriptor could be lost because of lost
+	// connection: after reconnection (reconnected is true) or when
+	// descriptor is removed (reconnected is false). can be nil
+	GapHandler func(
+		descriptor string,
+		unsubscribing_descriptors []string,
+		reconnected bool,
+	)
+
+	// if PoolSize is greater than 0, descriptors share up to PoolSize
+	// upstream connections, else each descriptor has own connection.
+	// GetDescriptorForRequest is used to find descriptor of messages
+	// received from shared connection. GetDescriptorForRequest and
+	// RemoteUnsubscribeCommand must be set in this mode. shared connection
+	// is closed when it has no descriptors left
+	PoolSize                int
+	GetDescriptorForRequest func(request *jsonrpc2.Request) string
 
 	GetDescriptorForParameter func(parameter interface{}) string
 	RespHandler               func(
@@ -157,72 +252,313 @@ type SubscriptionMgrOptions struct {
 	)
 }
 
+const (
+	DefaultReconnectMinDelay = 500 * time.Millisecond
+	DefaultReconnectMaxDelay = 30 * time.Second
+
+	DefaultRemoteUnsubscribeTimeout = 5 * time.Second
+
+	DefaultSubscribeTimeout = 30 * time.Second
+)
+
+// pendingSubscription is used by concurrent Subscribe() calls to wait for
+// remote subscription made by one of them
+type pendingSubscription struct {
+	done chan struct{}
+	// err, retry and unsubscribing_descriptor are set before done is
+	// closed. if retry is true, waiters should try to subscribe again.
+	// unsubscribing_descriptor is subscriber added for call which made
+	// subscription
+	err                      error
+	retry                    bool
+	unsubscribing_descriptor string
+
+	// set if call which made subscription stopped waiting for it. all
+	// fields are protected by descriptor_subscriptions_mutex
+	abandoned bool
+	// number of other calls waiting for subscription. if call which made
+	// subscription stopped waiting, subscription is kept for them
+	waiters int
+}
+
 type SubscriptionMgr struct {
 	options *SubscriptionMgrOptions
 
-	descriptor_subscriptions       map[string]*SubscriptionMgrSession
+	// ctx lives until Close(). remote subscriptions are made with it
+	ctx        context.Context
+	ctx_cancel context.CancelFunc
+
+	loggerHolder
+
+	dispatcher *subscriptionDispatcher
+
+	descriptor_subscriptions map[string]*SubscriptionMgrSession
+	// descriptors being subscribed or unsubscribed remotely
+	pending_subscriptions          map[string]*pendingSubscription
 	descriptor_subscriptions_mutex *sync.RWMutex
+
+	// set by Close(). protected by descriptor_subscriptions_mutex
+	closed bool
+
+	// shared connections of pooled mode. upstreams_dial_token is taken
+	// while new connection is being made
+	upstreams            []*subscriptionUpstream
+	upstreams_mutex      *sync.Mutex
+	upstreams_dial_token chan struct{}
 }
 
-func NewSubscriptionMgr(options *SubscriptionMgrOptions) *SubscriptionMgr {
+func NewSubscriptionMgr(options *SubscriptionMgrOptions) (*SubscriptionMgr, error) {
 	self := &SubscriptionMgr{
 		options:                        options,
 		descriptor_subscriptions:       make(map[string]*SubscriptionMgrSession),
+		pending_subscriptions:          make(map[string]*pendingSubscription),
 		descriptor_subscriptions_mutex: &sync.RWMutex{},
+		upstreams_mutex:                &sync.Mutex{},
+		upstreams_dial_token:           make(chan struct{}, 1),
+	}
+
+	self.ctx, self.ctx_cancel = context.WithCancel(context.Background())
+
+	logger := options.Logger
+	if logger == nil {
+		logger = NewStdLogger(nil, LogLevelInfo)
+	}
+	self.logger = WithFields(logger, LogFieldComponent, "SubscriptionMgr")
+
+	if self.pooled() && options.GetDescriptorForRequest == nil {
+		self.ctx_cancel()
+		return nil, errors.New("GetDescriptorForRequest must be set if PoolSize is used")
+	}
+
+	// without remote unsubscription, subscriptions of removed descriptors
+	// would stay on shared connections
+	if self.pooled() && options.RemoteUnsubscribeCommand == "" {
+		self.ctx_cancel()
+		return nil, errors.New("RemoteUnsubscribeCommand must be set if PoolSize is used")
 	}
-	return self
+
+	self.dispatcher = newSubscriptionDispatcher(self)
+
+	return self, nil
 }
 
-func (self *SubscriptionMgr) Log(txt ...interface{}) {
-	t := []interface{}{fmt.Sprintf("[SubscriptionMgr]")}
-	t = append(t, txt...)
-	log.Println(t...)
+// must be called with descriptor_subscriptions_mutex locked
+func (self *SubscriptionMgr) updateMetrics() {
+	if self.options.Metrics == nil {
+		return
+	}
+
+	subscribers := 0
+	for _, i := range self.descriptor_subscriptions {
+		subscribers += len(i.unsubscribing_descriptors)
+	}
+
+	self.options.Metrics.GaugeSet(
+		MetricSubscriptionMgrDescriptors,
+		"number of descriptors with remote subscription",
+		float64(len(self.descriptor_subscriptions)),
+		"manager", self.options.Name,
+	)
+	self.options.Metrics.GaugeSet(
+		MetricSubscriptionMgrSubscribers,
+		"number of subscribers of all descriptors",
+		float64(subscribers),
+		"manager", self.options.Name,
+	)
 }
 
 func (self *SubscriptionMgr) Subscriptions(descriptor string) (unsubscribing_descriptors []string, err error) {
+	self.descriptor_subscriptions_mutex.RLock()
+	defer self.descriptor_subscriptions_mutex.RUnlock()
 
-	if _, ok := self.descriptor_subscriptions[descriptor]; !ok {
+	mgr_sess, ok := self.descriptor_subscriptions[descriptor]
+	if !ok {
 		return
 	}
 
-	x := self.descriptor_subscriptions[descriptor].unsubscribing_descriptors
-	unsubscribing_descriptors = make([]string, len(x))
-	copy(unsubscribing_descriptors, x)
+	unsubscribing_descriptors = mgr_sess.subscribers()
 	return
 }
 
+// Subscribe adds new subscriber to descriptor of
+// remote_subscribe_command_parameter. if descriptor has no remote
+// subscription yet, it's made (connecting to upstream if needed) without
+// blocking subscriptions to other descriptors. concurrent calls for same
+// descriptor wait for one remote subscription. ctx limits time of waiting:
+// remote subscription is finished in background and undone if it's not
+// needed anymore
 func (self *SubscriptionMgr) Subscribe(
+	ctx context.Context,
 	remote_subscribe_command_parameter interface{},
 ) (descriptor string, unsubscribing_descriptor string, err error) {
-	self.descriptor_subscriptions_mutex.Lock()
-	defer func() {
-		self.descriptor_subscriptions_mutex.Unlock()
-	}()
 
 	descriptor = self.options.GetDescriptorForParameter(remote_subscribe_command_parameter)
 
-	mgr_sess, ok := self.descriptor_subscriptions[descriptor]
-	if !ok {
-		mgr_sess, err = NewSubscriptionMgrSession(self, descriptor, remote_subscribe_command_parameter)
-		if err != nil {
+	for {
+		self.descriptor_subscriptions_mutex.Lock()
+
+		if self.closed {
+			self.descriptor_subscriptions_mutex.Unlock()
+			err = ErrSubscriptionMgrClosed
 			return
 		}
-		self.descriptor_subscriptions[descriptor] = mgr_sess
+
+		mgr_sess, ok := self.descriptor_subscriptions[descriptor]
+		if ok {
+			unsubscribing_descriptor = self.addSubscriber(mgr_sess)
+			self.descriptor_subscriptions_mutex.Unlock()
+			return
+		}
+
+		pending, ok := self.pending_subscriptions[descriptor]
+		if !ok {
+			// mutex stays locked
+			break
+		}
+
+		pending.waiters++
+
+		self.descriptor_subscriptions_mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			self.descriptor_subscriptions_mutex.Lock()
+			select {
+			case <-pending.done:
+				// subscription could be kept for this call, so it must
+				// be taken
+			default:
+				pending.waiters--
+				self.descriptor_subscriptions_mutex.Unlock()
+				err = ctx.Err()
+				return
+			}
+			self.descriptor_subscriptions_mutex.Unlock()
+		case <-pending.done:
+		}
+
+		if pending.err != nil && !pending.retry {
+			err = pending.err
+			return
+		}
+	}
+
+	// this call makes remote subscription, others wait for it
+	pending := &pendingSubscription{done: make(chan struct{})}
+	self.pending_subscriptions[descriptor] = pending
+
+	self.descriptor_subscriptions_mutex.Unlock()
+
+	go self.makeSubscription(pending, descriptor, remote_subscribe_command_parameter)
+
+	select {
+	case <-ctx.Done():
+	case <-pending.done:
+	}
+
+	self.descriptor_subscriptions_mutex.Lock()
+	defer self.descriptor_subscriptions_mutex.Unlock()
+
+	select {
+	case <-pending.done:
+	default:
+		// makeSubscription() undoes subscription
+		pending.abandoned = true
+		err = ctx.Err()
+		return
+	}
+
+	if pending.err != nil {
+		err = pending.err
+		return
+	}
+
+	unsubscribing_descriptor = pending.unsubscribing_descriptor
+
+	return
+}
+
+// makeSubscription makes remote subscription for Subscribe() and finishes
+// pending. if Subscribe() has stopped waiting, subscription is passed to
+// other waiters, or undone if there are none
+func (self *SubscriptionMgr) makeSubscription(
+	pending *pendingSubscription,
+	descriptor string,
+	remote_subscribe_command_parameter interface{},
+) {
+
+	timeout := self.options.SubscribeTimeout
+	if timeout == 0 {
+		timeout = DefaultSubscribeTimeout
 	}
 
-	unsubscribing_descriptor = uuid.NewV4().String()
+	ctx, cancel := context.WithTimeout(self.ctx, timeout)
+	defer cancel()
 
+	mgr_sess, err := NewSubscriptionMgrSession(
+		ctx,
+		self,
+		descriptor,
+		remote_subscribe_command_parameter,
+	)
+
+	self.descriptor_subscriptions_mutex.Lock()
+	defer self.descriptor_subscriptions_mutex.Unlock()
+
+	if x, ok := self.pending_subscriptions[descriptor]; ok && x == pending {
+		delete(self.pending_subscriptions, descriptor)
+	}
+
+	defer close(pending.done)
+
+	if err == nil && self.closed {
+		// Close() was called while subscribing
+		mgr_sess.Destroy()
+		err = ErrSubscriptionMgrClosed
+	}
+
+	if err != nil {
+		pending.err = err
+		return
+	}
+
+	if pending.abandoned && pending.waiters == 0 {
+		self.Log(
+			fmt.Sprintf("subscription to `%s` isn't needed anymore. undoing it..", descriptor),
+		)
+		self.inRemoveDescriptor(mgr_sess)
+		pending.retry = true
+		return
+	}
+
+	// waiters add own subscribers after done is closed
+	self.descriptor_subscriptions[descriptor] = mgr_sess
+
+	if !pending.abandoned {
+		pending.unsubscribing_descriptor = self.addSubscriber(mgr_sess)
+	}
+}
+
+// must be called with descriptor_subscriptions_mutex locked
+func (self *SubscriptionMgr) addSubscriber(mgr_sess *SubscriptionMgrSession) string {
+
+	unsubscribing_descriptor := uuid.NewV4().String()
+
+	mgr_sess.unsubscribing_descriptors_mutex.Lock()
 	mgr_sess.unsubscribing_descriptors = append(mgr_sess.unsubscribing_descriptors, unsubscribing_descriptor)
+	mgr_sess.unsubscribing_descriptors_mutex.Unlock()
+
+	self.updateMetrics()
 
 	self.Log(
 		fmt.Sprintf(
 			"new subscribtion to %s created. currently subscribed %d",
-			descriptor,
+			mgr_sess.descriptor,
 			len(mgr_sess.unsubscribing_descriptors),
 		),
 	)
 
-	return
+	return unsubscribing_descriptor
 }
 
 func (self *SubscriptionMgr) UnsubscribeAllDescriptors(unsubscribing_descriptor string) {
@@ -241,11 +577,39 @@ func (self *SubscriptionMgr) UnsubscribeAllDescriptors(unsubscribing_descriptor
 }
 
 func (self *SubscriptionMgr) UnsubscribeEverything() {
-	for _, i := range self.descriptor_subscriptions {
+	self.descriptor_subscriptions_mutex.Lock()
+	for k, i := range self.descriptor_subscriptions {
+		delete(self.descriptor_subscriptions, k)
+		i.Destroy()
+	}
+	self.updateMetrics()
+	self.descriptor_subscriptions_mutex.Unlock()
+
+	self.upstreams_mutex.Lock()
+	upstreams := make([]*subscriptionUpstream, len(self.upstreams))
+	copy(upstreams, self.upstreams)
+	self.upstreams_mutex.Unlock()
+
+	for _, i := range upstreams {
 		i.Destroy()
 	}
 }
 
+// Close destroys all descriptors (without calling RemoteUnsubscribeCommand),
+// closes upstream connections and stops dispatch workers. queued messages
+// are dropped. Subscribe() returns ErrSubscriptionMgrClosed after Close()
+func (self *SubscriptionMgr) Close() {
+	self.descriptor_subscriptions_mutex.Lock()
+	self.closed = true
+	self.descriptor_subscriptions_mutex.Unlock()
+
+	self.ctx_cancel()
+
+	self.UnsubscribeEverything()
+
+	self.dispatcher.stop()
+}
+
 func (self *SubscriptionMgr) Unsubscribe(descriptor string, unsubscribing_descriptor string) {
 	self.descriptor_subscriptions_mutex.Lock()
 	defer self.descriptor_subscriptions_mutex.Unlock()
@@ -260,12 +624,9 @@ func (self *SubscriptionMgr) inUnsubscribe(descriptor string, unsubscribing_desc
 		return
 	}
 
-	for i := len(mgr_sess.unsubscribing_descriptors) - 1; i != -1; i -= 1 {
-		session := mgr_sess.unsubscribing_descriptors[i]
-		if session == unsubscribing_descriptor {
-			mgr_sess.unsubscribing_descriptors = append(mgr_sess.unsubscribing_descriptors[:i], mgr_sess.unsubscribing_descriptors[i+1:]...)
-		}
-	}
+	mgr_sess.removeSubscriber(unsubscribing_descriptor)
+
+	self.dispatcher.drop(descriptor, unsubscribing_descriptor)
 
 	self.Log(
 		fmt.Sprintf(
@@ -279,8 +640,201 @@ func (self *SubscriptionMgr) inUnsubscribe(descriptor string, unsubscribing_desc
 		self.Log(
 			fmt.Sprintf("Descriptor `%s` have 0 subscribers. destroying it..", descriptor),
 		)
+		self.inRemoveDescriptor(mgr_sess)
+	}
+
+	self.updateMetrics()
+
+}
+
+// inRemoveDescriptor removes descriptor and calls RemoteUnsubscribeCommand
+// in background. must be called with descriptor_subscriptions_mutex locked
+func (self *SubscriptionMgr) inRemoveDescriptor(mgr_sess *SubscriptionMgrSession) {
+
+	descriptor := mgr_sess.descriptor
+
+	if x, ok := self.descriptor_subscriptions[descriptor]; ok && x == mgr_sess {
 		delete(self.descriptor_subscriptions, descriptor)
-		mgr_sess.Destroy()
 	}
 
+	// new subscriptions to descriptor wait until remote unsubscription
+	// is done, so it doesn't cancel them
+	pending := &pendingSubscription{
+		done:  make(chan struct{}),
+		retry: true,
+	}
+	self.pending_subscriptions[descriptor] = pending
+
+	// done in background, as mutex is locked
+	go func() {
+		mgr_sess.unsubscribeRemote()
+
+		self.descriptor_subscriptions_mutex.Lock()
+		if x, ok := self.pending_subscriptions[descriptor]; ok && x == pending {
+			delete(self.pending_subscriptions, descriptor)
+		}
+		close(pending.done)
+		self.descriptor_subscriptions_mutex.Unlock()
+	}()
+}
+
+// called by dispatcher with DispatchDisconnect policy
+func (self *SubscriptionMgr) disconnectSlowSubscriber(
+	descriptor string,
+	unsubscribing_descriptor string,
+) {
+	self.LogError(
+		fmt.Sprintf(
+			"subscriber %s of %s is too slow. unsubscribing it",
+			unsubscribing_descriptor,
+			descriptor,
+		),
+	)
+
+	self.options.Metrics.CounterAdd(
+		MetricSubscriptionMgrSlowSubscribers,
+		"number of subscribers unsubscribed because of full queue",
+		1,
+		"manager", self.options.Name,
+	)
+
+	self.Unsubscribe(descriptor, unsubscribing_descriptor)
+
+	if self.options.SlowSubscriberHandler != nil {
+		self.options.SlowSubscriberHandler(descriptor, unsubscribing_descriptor)
+	}
+}
+
+// removeDeadSession removes descriptor, which connection is lost and can't
+// be restored, with all it's subscribers
+func (self *SubscriptionMgr) removeDeadSession(mgr_sess *SubscriptionMgrSession) {
+	self.descriptor_subscriptions_mutex.Lock()
+
+	if x, ok := self.descriptor_subscriptions[mgr_sess.descriptor]; ok && x == mgr_sess {
+		delete(self.descriptor_subscriptions, mgr_sess.descriptor)
+		self.updateMetrics()
+	}
+
+	self.descriptor_subscriptions_mutex.Unlock()
+
+	mgr_sess.Destroy()
+
+	self.notifyGap(mgr_sess, false)
+
+	for _, i := range mgr_sess.subscribers() {
+		self.dispatcher.drop(mgr_sess.descriptor, i)
+	}
+}
+
+func (self *SubscriptionMgr) notifyGap(mgr_sess *SubscriptionMgrSession, reconnected bool) {
+	if self.options.GapHandler == nil {
+		return
+	}
+
+	self.options.GapHandler(mgr_sess.descriptor, mgr_sess.subscribers(), reconnected)
+}
+
+func (self *SubscriptionMgr) pooled() bool {
+	return self.options.PoolSize > 0
+}
+
+// getUpstream returns connection for new descriptor. in pooled mode new
+// connections are made (one at a time) until PoolSize is reached. least
+// used existing connection is returned if pool is full or other
+// connection is being made. returned upstream is reserved, so it isn't
+// closed before descriptor is attached to it by subscribe()
+func (self *SubscriptionMgr) getUpstream(ctx context.Context) (*subscriptionUpstream, error) {
+
+	if !self.pooled() {
+		return newSubscriptionUpstream(ctx, self, false)
+	}
+
+	for {
+		self.upstreams_mutex.Lock()
+		full := len(self.upstreams) >= self.options.PoolSize
+		least_used := self.leastUsedUpstream()
+		if least_used != nil {
+			least_used.reserve()
+		}
+		self.upstreams_mutex.Unlock()
+
+		if full {
+			return least_used, nil
+		}
+
+		if least_used != nil {
+			select {
+			case self.upstreams_dial_token <- struct{}{}:
+				// new connection is made instead
+				least_used.release()
+			default:
+				return least_used, nil
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case self.upstreams_dial_token <- struct{}{}:
+			}
+		}
+
+		self.upstreams_mutex.Lock()
+		full = len(self.upstreams) >= self.options.PoolSize
+		self.upstreams_mutex.Unlock()
+
+		if full {
+			// filled while waiting for token
+			<-self.upstreams_dial_token
+			continue
+		}
+
+		upstream, err := newSubscriptionUpstream(ctx, self, true)
+		if err == nil {
+			self.upstreams_mutex.Lock()
+			self.upstreams = append(self.upstreams, upstream)
+			self.upstreams_mutex.Unlock()
+		}
+
+		<-self.upstreams_dial_token
+
+		return upstream, err
+	}
+}
+
+// must be called with upstreams_mutex locked. upstreams being
+// reconnected are returned only if all upstreams are reconnecting. nil if
+// there are no upstreams
+func (self *SubscriptionMgr) leastUsedUpstream() *subscriptionUpstream {
+	var ret *subscriptionUpstream
+	ret_count := 0
+	ret_ready := false
+
+	for _, i := range self.upstreams {
+		count, ready := i.usage()
+		if ret == nil ||
+			(ready && !ret_ready) ||
+			(ready == ret_ready && count < ret_count) {
+			ret = i
+			ret_count = count
+			ret_ready = ready
+		}
+	}
+
+	return ret
+}
+
+func (self *SubscriptionMgr) removeUpstream(upstream *subscriptionUpstream) {
+	self.upstreams_mutex.Lock()
+	defer self.upstreams_mutex.Unlock()
+
+	self.inRemoveUpstream(upstream)
+}
+
+// must be called with upstreams_mutex locked
+func (self *SubscriptionMgr) inRemoveUpstream(upstream *subscriptionUpstream) {
+	for i := len(self.upstreams) - 1; i != -1; i -= 1 {
+		if self.upstreams[i] == upstream {
+			self.upstreams = append(self.upstreams[:i], self.upstreams[i+1:]...)
+		}
+	}
 }
@@ -0,0 +1,604 @@
+package gojsonrpc2server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// subscriptionUpstream is connection to upstream server. it's either
+// dedicated to one descriptor or, in pooled mode, shared by many of them.
+// lost connection is reestablished and all descriptors are subscribed
+// again
+type subscriptionUpstream struct {
+	mgr    *SubscriptionMgr
+	pooled bool
+
+	// ctx lives until upstream is destroyed. it's used by all connections
+	// made by upstream
+	ctx        context.Context
+	ctx_cancel context.CancelFunc
+
+	jsonrpc2_conn *jsonrpc2.Conn
+	// closed while connection is established and all descriptors are
+	// subscribed on it. replaced when connection is lost
+	ready chan struct{}
+	// descriptors using this upstream
+	sessions map[string]*SubscriptionMgrSession
+	// number of descriptors going to use this upstream. see getUpstream()
+	reserved int
+	mutex    *sync.Mutex
+
+	destroy_guard *sync.Once
+}
+
+// ctx limits time of connecting
+func newSubscriptionUpstream(
+	ctx context.Context,
+	mgr *SubscriptionMgr,
+	pooled bool,
+) (*subscriptionUpstream, error) {
+
+	self := &subscriptionUpstream{
+		mgr:           mgr,
+		pooled:        pooled,
+		ready:         make(chan struct{}),
+		sessions:      make(map[string]*SubscriptionMgrSession),
+		reserved:      1,
+		mutex:         &sync.Mutex{},
+		destroy_guard: &sync.Once{},
+	}
+
+	self.ctx, self.ctx_cancel = context.WithCancel(context.Background())
+
+	jsonrpc2_conn, err := self.connect(ctx)
+	if err != nil {
+		self.ctx_cancel()
+		return nil, err
+	}
+
+	close(self.ready)
+
+	mgr.options.Metrics.GaugeAdd(
+		MetricSubscriptionMgrConnections,
+		"number of upstream connections",
+		1,
+		"manager", self.mgr.options.Name,
+	)
+
+	go self.watch(jsonrpc2_conn)
+
+	return self, nil
+}
+
+type subscriptionDialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// connect makes new connection to upstream and authenticates on it.
+// GetNewConnection and Authenticator don't accept context, so they are
+// abandoned (and connection is closed) if ctx is done before they return
+func (self *subscriptionUpstream) connect(ctx context.Context) (*jsonrpc2.Conn, error) {
+
+	dial_result := make(chan subscriptionDialResult, 1)
+
+	go func() {
+		conn, err := self.mgr.options.GetNewConnection()
+		dial_result <- subscriptionDialResult{conn: conn, err: err}
+	}()
+
+	var conn net.Conn
+
+	select {
+	case <-ctx.Done():
+		go func() {
+			res := <-dial_result
+			if res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		self.mgr.LogError("  connection error:", ctx.Err())
+		return nil, ctx.Err()
+	case res := <-dial_result:
+		if res.err != nil {
+			self.mgr.LogError("  connection error:", res.err)
+			return nil, res.err
+		}
+		conn = res.conn
+	}
+
+	// tcp, err := net.Dial("tcp", self.mgr.options.Context.options.CmdLineOptions.ServerInternal)
+	// if err != nil {
+	// 	return nil, err
+	// }
+
+	// if self.mgr.options.Context.options.ServerOptions.EnableTLS {
+	// 	tcp = tls.Client(tcp, self.mgr.options.Context.options.ServerOptions.TLSConfig)
+	// }
+
+	codec := self.mgr.options.Codec
+	if codec == nil {
+		codec = jsonrpc2.VarintObjectCodec{}
+	}
+
+	bs := jsonrpc2.NewBufferedStream(conn, codec)
+
+	h := jsonrpc2.Handler(self)
+
+	if self.mgr.options.UseAsyncHandler {
+		h = jsonrpc2.AsyncHandler(h)
+	}
+
+	jsonrpc2_conn := jsonrpc2.NewConn(self.ctx, bs, h)
+
+	self.mutex.Lock()
+	self.jsonrpc2_conn = jsonrpc2_conn
+	self.mutex.Unlock()
+
+	// Destroy() could be called before jsonrpc2_conn is set
+	if self.ctx.Err() != nil {
+		jsonrpc2_conn.Close()
+		return nil, self.ctx.Err()
+	}
+
+	if self.mgr.options.Authenticator != nil {
+		auth_done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				jsonrpc2_conn.Close()
+			case <-auth_done:
+			}
+		}()
+
+		err := self.mgr.options.Authenticator(jsonrpc2_conn)
+		close(auth_done)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			self.mgr.LogError("  authentication error:", err)
+			jsonrpc2_conn.Close()
+			return nil, err
+		}
+	}
+
+	return jsonrpc2_conn, nil
+}
+
+func (self *subscriptionUpstream) getConn() *jsonrpc2.Conn {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.jsonrpc2_conn
+}
+
+// must be called with mutex locked
+func (self *subscriptionUpstream) isReady() bool {
+	select {
+	case <-self.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitReady waits for upstream to be reconnected
+func (self *subscriptionUpstream) waitReady(ctx context.Context) error {
+	self.mutex.Lock()
+	ready := self.ready
+	self.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-self.ctx.Done():
+		return self.ctx.Err()
+	case <-ready:
+		return nil
+	}
+}
+
+// usage returns number of descriptors using or going to use upstream and
+// whether it's connected
+func (self *subscriptionUpstream) usage() (int, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.sessions) + self.reserved, self.isReady()
+}
+
+// must be called with mgr's upstreams_mutex locked
+func (self *subscriptionUpstream) reserve() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.reserved++
+}
+
+// release cancels reserve(). unused upstream is closed
+func (self *subscriptionUpstream) release() {
+	self.mutex.Lock()
+	self.reserved--
+	self.mutex.Unlock()
+
+	self.closeIfUnused()
+}
+
+// subscribe calls RemoteSubscribeCommand for mgr_sess and attaches it to
+// upstream instead of reservation made by getUpstream(). reconnecting
+// upstream is waited for. ctx limits time of waiting and of call
+func (self *subscriptionUpstream) subscribe(
+	ctx context.Context,
+	mgr_sess *SubscriptionMgrSession,
+) error {
+
+	var jsonrpc2_conn *jsonrpc2.Conn
+
+	for jsonrpc2_conn == nil {
+		err := self.waitReady(ctx)
+		if err != nil {
+			self.release()
+			return err
+		}
+
+		// attached before call, so notifications sent by server right
+		// after subscription are not lost. watch() doesn't subscribe
+		// mgr_sess while it's subscribing
+		self.mutex.Lock()
+		if self.isReady() {
+			self.sessions[mgr_sess.descriptor] = mgr_sess
+			self.reserved--
+			mgr_sess.subscribing = true
+			jsonrpc2_conn = self.jsonrpc2_conn
+		}
+		self.mutex.Unlock()
+	}
+
+	for {
+		err := self.callSubscribe(ctx, jsonrpc2_conn, mgr_sess)
+
+		self.mutex.Lock()
+		reconnected := self.jsonrpc2_conn != jsonrpc2_conn || !self.isReady()
+		if err == nil {
+			mgr_sess.subscribed_conn = jsonrpc2_conn
+			if !reconnected {
+				mgr_sess.subscribing = false
+				self.mutex.Unlock()
+				return nil
+			}
+		}
+		self.mutex.Unlock()
+
+		if err != nil && !reconnected {
+			self.detach(mgr_sess)
+			return err
+		}
+
+		// upstream is reconnected during call and mgr_sess could be
+		// skipped by watch()
+		err = self.waitReady(ctx)
+		if err != nil {
+			self.detach(mgr_sess)
+			return err
+		}
+		jsonrpc2_conn = self.getConn()
+	}
+}
+
+func (self *subscriptionUpstream) callSubscribe(
+	ctx context.Context,
+	jsonrpc2_conn *jsonrpc2.Conn,
+	mgr_sess *SubscriptionMgrSession,
+) error {
+
+	var res json.RawMessage
+	// self.mgr.Log("calling server for subscription. param: ", parameters)
+	err := jsonrpc2_conn.Call(
+		ctx,
+		self.mgr.options.RemoteSubscribeCommand,
+		mgr_sess.parameters,
+		&res,
+	)
+	if err != nil {
+		self.mgr.LogError("  error calling server for subscription:", err)
+		return err
+	}
+
+	mgr_sess.setSubscribeResult(res)
+
+	self.mgr.Log("  ok")
+
+	return nil
+}
+
+// unsubscribe calls RemoteUnsubscribeCommand (if set) for mgr_sess and
+// detaches it from upstream
+func (self *subscriptionUpstream) unsubscribe(mgr_sess *SubscriptionMgrSession) {
+	defer self.detach(mgr_sess)
+
+	options := self.mgr.options
+
+	if options.RemoteUnsubscribeCommand == "" {
+		return
+	}
+
+	parameter := mgr_sess.parameters
+	if options.GetRemoteUnsubscribeParameter != nil {
+		parameter = options.GetRemoteUnsubscribeParameter(
+			mgr_sess.parameters,
+			mgr_sess.getSubscribeResult(),
+		)
+	}
+
+	timeout := options.RemoteUnsubscribeTimeout
+	if timeout <= 0 {
+		timeout = DefaultRemoteUnsubscribeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(self.ctx, timeout)
+	defer cancel()
+
+	var res interface{}
+	err := self.getConn().Call(ctx, options.RemoteUnsubscribeCommand, parameter, &res)
+	if err != nil {
+		self.mgr.LogError(
+			fmt.Sprintf("error calling server to unsubscribe `%s`:", mgr_sess.descriptor),
+			err,
+		)
+	}
+}
+
+// detach removes mgr_sess from upstream. dedicated upstream is destroyed,
+// pooled one - if no descriptors are left
+func (self *subscriptionUpstream) detach(mgr_sess *SubscriptionMgrSession) {
+	self.mutex.Lock()
+	if x, ok := self.sessions[mgr_sess.descriptor]; ok && x == mgr_sess {
+		delete(self.sessions, mgr_sess.descriptor)
+	}
+	mgr_sess.subscribing = false
+	self.mutex.Unlock()
+
+	self.closeIfUnused()
+}
+
+// closeIfUnused destroys dedicated upstream or pooled one without
+// descriptors and reservations
+func (self *subscriptionUpstream) closeIfUnused() {
+	if self.pooled {
+		// upstreams_mutex is locked first, so getUpstream() can't reserve
+		// upstream being destroyed
+		self.mgr.upstreams_mutex.Lock()
+		self.mutex.Lock()
+		unused := len(self.sessions) == 0 && self.reserved == 0
+		self.mutex.Unlock()
+		if unused {
+			self.mgr.inRemoveUpstream(self)
+		}
+		self.mgr.upstreams_mutex.Unlock()
+
+		if !unused {
+			return
+		}
+
+		self.mgr.LogDebug("closing unused upstream connection")
+	}
+
+	self.Destroy()
+}
+
+// Handle passes requests from upstream to descriptors. in pooled mode
+// descriptor is found using GetDescriptorForRequest
+func (self *subscriptionUpstream) Handle(
+	ctx context.Context,
+	conn *jsonrpc2.Conn,
+	req *jsonrpc2.Request,
+) {
+	var mgr_sess *SubscriptionMgrSession
+
+	self.mutex.Lock()
+	if self.pooled {
+		mgr_sess = self.sessions[self.mgr.options.GetDescriptorForRequest(req)]
+	} else {
+		for _, i := range self.sessions {
+			mgr_sess = i
+		}
+	}
+	self.mutex.Unlock()
+
+	if mgr_sess == nil {
+		self.mgr.LogDebug("no descriptor for request", req.Method, "from upstream")
+		if !req.Notif {
+			err := conn.ReplyWithError(ctx, req.ID, ErrInvalidParams("unknown descriptor"))
+			if err != nil {
+				self.mgr.LogError("can't send error message to upstream:", err)
+			}
+		}
+		return
+	}
+
+	mgr_sess.Handle(ctx, conn, req)
+}
+
+// watch waits for connection to be lost, reconnects and subscribes all
+// descriptors again
+func (self *subscriptionUpstream) watch(jsonrpc2_conn *jsonrpc2.Conn) {
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-jsonrpc2_conn.DisconnectNotify():
+		}
+
+		if self.ctx.Err() != nil {
+			return
+		}
+
+		if self.mgr.options.DisableReconnect {
+			self.mgr.LogError("upstream connection lost")
+			self.giveUp()
+			return
+		}
+
+		self.mgr.LogError("upstream connection lost. reconnecting..")
+
+		self.mutex.Lock()
+		if self.isReady() {
+			self.ready = make(chan struct{})
+		}
+		self.mutex.Unlock()
+
+		var err error
+		jsonrpc2_conn, err = self.reconnect()
+		if err != nil {
+			if self.ctx.Err() == nil {
+				self.mgr.LogError("giving up reconnecting upstream:", err)
+				self.giveUp()
+			}
+			return
+		}
+
+		self.mgr.Log("upstream reconnected")
+
+		// descriptors being subscribed by subscribe() or already
+		// subscribed by it on new connection are skipped
+		self.mutex.Lock()
+		sessions := make([]*SubscriptionMgrSession, 0, len(self.sessions))
+		for _, i := range self.sessions {
+			if i.subscribing || i.subscribed_conn == jsonrpc2_conn {
+				continue
+			}
+			sessions = append(sessions, i)
+		}
+		self.mutex.Unlock()
+
+		for _, i := range sessions {
+			err := self.callSubscribe(self.ctx, jsonrpc2_conn, i)
+			if err != nil {
+				self.mgr.LogError(
+					fmt.Sprintf("can't subscribe `%s` again:", i.descriptor),
+					err,
+				)
+				self.mgr.removeDeadSession(i)
+				continue
+			}
+
+			self.mutex.Lock()
+			i.subscribed_conn = jsonrpc2_conn
+			self.mutex.Unlock()
+
+			self.mgr.notifyGap(i, true)
+		}
+
+		self.mutex.Lock()
+		close(self.ready)
+		self.mutex.Unlock()
+	}
+}
+
+// reconnect tries to connect with exponential backoff until success,
+// upstream destruction or ReconnectMaxAttempts
+func (self *subscriptionUpstream) reconnect() (*jsonrpc2.Conn, error) {
+
+	options := self.mgr.options
+
+	delay := options.ReconnectMinDelay
+	if delay <= 0 {
+		delay = DefaultReconnectMinDelay
+	}
+
+	max_delay := options.ReconnectMaxDelay
+	if max_delay <= 0 {
+		max_delay = DefaultReconnectMaxDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-self.ctx.Done():
+			timer.Stop()
+			return nil, self.ctx.Err()
+		case <-timer.C:
+		}
+
+		jsonrpc2_conn, err := self.connect(self.ctx)
+		if err == nil {
+			options.Metrics.CounterAdd(
+				MetricSubscriptionMgrReconnects,
+				"number of reconnection attempts to upstream",
+				1,
+				"manager", self.mgr.options.Name,
+				"result", "success",
+			)
+			return jsonrpc2_conn, nil
+		}
+
+		options.Metrics.CounterAdd(
+			MetricSubscriptionMgrReconnects,
+			"number of reconnection attempts to upstream",
+			1,
+			"manager", self.mgr.options.Name,
+			"result", "failure",
+		)
+
+		if self.ctx.Err() != nil {
+			return nil, self.ctx.Err()
+		}
+
+		if options.ReconnectMaxAttempts > 0 &&
+			attempt >= options.ReconnectMaxAttempts {
+			return nil, err
+		}
+
+		delay *= 2
+		if delay > max_delay {
+			delay = max_delay
+		}
+	}
+}
+
+// giveUp destroys upstream and removes all it's descriptors
+func (self *subscriptionUpstream) giveUp() {
+
+	self.Destroy()
+
+	self.mutex.Lock()
+	sessions := make([]*SubscriptionMgrSession, 0, len(self.sessions))
+	for _, i := range self.sessions {
+		sessions = append(sessions, i)
+	}
+	self.mutex.Unlock()
+
+	for _, i := range sessions {
+		self.mgr.removeDeadSession(i)
+	}
+}
+
+func (self *subscriptionUpstream) Destroy() {
+	self.destroy_guard.Do(
+		func() {
+			self.ctx_cancel()
+
+			jsonrpc2_conn := self.getConn()
+			if jsonrpc2_conn != nil {
+				jsonrpc2_conn.Close()
+			}
+
+			self.mgr.removeUpstream(self)
+
+			self.mgr.options.Metrics.GaugeAdd(
+				MetricSubscriptionMgrConnections,
+				"number of upstream connections",
+				-1,
+				"manager", self.mgr.options.Name,
+			)
+		},
+	)
+}
@@ -0,0 +1,840 @@
+package gojsonrpc2server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// testUpstream is upstream server for SubscriptionMgr tests. all received
+// requests are passed to calls as "method params". "subscribe" is replied
+// with parameter, other methods - with true
+type testUpstream struct {
+	listener net.Listener
+
+	calls chan string
+	// connections with successful "subscribe" calls
+	conns chan *jsonrpc2.Conn
+
+	// if not nil, called before reply. returned error is sent to client
+	before_reply func(req *jsonrpc2.Request) error
+
+	// accessed atomically
+	dials int64
+	// if not 0, dialing fails
+	fail_dial int32
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self := &testUpstream{
+		listener: listener,
+		calls:    make(chan string, 100),
+		conns:    make(chan *jsonrpc2.Conn, 100),
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			jsonrpc2.NewConn(
+				context.Background(),
+				jsonrpc2.NewBufferedStream(conn, jsonrpc2.VarintObjectCodec{}),
+				jsonrpc2.AsyncHandler(self),
+			)
+		}
+	}()
+
+	return self
+}
+
+func (self *testUpstream) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	params := ""
+	if req.Params != nil {
+		params = string(*req.Params)
+	}
+	self.calls <- req.Method + " " + params
+
+	if self.before_reply != nil {
+		err := self.before_reply(req)
+		if err != nil {
+			conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: err.Error()})
+			return
+		}
+	}
+
+	if req.Method != "subscribe" {
+		conn.Reply(ctx, req.ID, true)
+		return
+	}
+
+	conn.Reply(ctx, req.ID, req.Params)
+	self.conns <- conn
+}
+
+func (self *testUpstream) dial() (net.Conn, error) {
+	atomic.AddInt64(&self.dials, 1)
+	if atomic.LoadInt32(&self.fail_dial) != 0 {
+		return nil, errors.New("dial failed")
+	}
+	return net.Dial("tcp", self.listener.Addr().String())
+}
+
+// testSubscriptionMgr makes SubscriptionMgr connected to upstream. params
+// of received messages are passed to returned channel as
+// "descriptor subscriber params"
+func testSubscriptionMgr(
+	t *testing.T,
+	upstream *testUpstream,
+	options *SubscriptionMgrOptions,
+) (*SubscriptionMgr, chan string) {
+	t.Helper()
+
+	received := make(chan string, 100)
+
+	options.Logger = LogFunc(func(...interface{}) {})
+	options.GetNewConnection = upstream.dial
+	options.RemoteSubscribeCommand = "subscribe"
+	options.GetDescriptorForParameter = func(parameter interface{}) string {
+		return parameter.(string)
+	}
+	options.RespHandler = func(
+		descriptor string,
+		unsubscribing_descriptor string,
+		request *jsonrpc2.Request,
+		uuid_str string,
+	) {
+		received <- descriptor + " " + unsubscribing_descriptor + " " + string(*request.Params)
+	}
+
+	mgr, err := NewSubscriptionMgr(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mgr.Close)
+
+	return mgr, received
+}
+
+func testExpect(t *testing.T, c chan string, expected string) {
+	t.Helper()
+
+	select {
+	case x := <-c:
+		if x != expected {
+			t.Fatal("expected", expected, "got", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for", expected)
+	}
+}
+
+func testUpstreamConn(t *testing.T, upstream *testUpstream) *jsonrpc2.Conn {
+	t.Helper()
+
+	select {
+	case x := <-upstream.conns:
+		return x
+	case <-time.After(5 * time.Second):
+		t.Fatal("no subscription on upstream")
+	}
+	return nil
+}
+
+func TestSubscriptionMgrReconnect(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	gaps := make(chan string, 10)
+
+	mgr, received := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			ReconnectMinDelay:    10 * time.Millisecond,
+			ReconnectMaxAttempts: 3,
+			GapHandler: func(
+				descriptor string,
+				unsubscribing_descriptors []string,
+				reconnected bool,
+			) {
+				if reconnected {
+					gaps <- descriptor + " reconnected"
+				} else {
+					gaps <- descriptor + " removed"
+				}
+			},
+		},
+	)
+
+	_, subscriber, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	conn := testUpstreamConn(t, upstream)
+	conn.Notify(context.Background(), "event", 1)
+	testExpect(t, received, "a "+subscriber+" 1")
+
+	conn.Close()
+
+	testExpect(t, gaps, "a reconnected")
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	conn = testUpstreamConn(t, upstream)
+	conn.Notify(context.Background(), "event", 2)
+	testExpect(t, received, "a "+subscriber+" 2")
+
+	atomic.StoreInt32(&upstream.fail_dial, 1)
+	dials := atomic.LoadInt64(&upstream.dials)
+
+	conn.Close()
+
+	testExpect(t, gaps, "a removed")
+
+	if x := atomic.LoadInt64(&upstream.dials) - dials; x != 3 {
+		t.Fatal("unexpected number of reconnection attempts:", x)
+	}
+
+	subscribers, _ := mgr.Subscriptions("a")
+	if len(subscribers) != 0 {
+		t.Fatal("descriptor isn't removed after reconnection failure")
+	}
+
+	atomic.StoreInt32(&upstream.fail_dial, 0)
+
+	_, _, err = mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal("can't subscribe again:", err)
+	}
+}
+
+func TestSubscriptionMgrDisableReconnect(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			DisableReconnect: true,
+		},
+	)
+
+	_, _, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testUpstreamConn(t, upstream).Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subscribers, _ := mgr.Subscriptions("a")
+		if len(subscribers) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("descriptor isn't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if x := atomic.LoadInt64(&upstream.dials); x != 1 {
+		t.Fatal("reconnected with DisableReconnect:", x)
+	}
+}
+
+func TestSubscriptionMgrRemoteUnsubscribe(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			RemoteUnsubscribeCommand: "unsubscribe",
+			GetRemoteUnsubscribeParameter: func(
+				subscribe_parameter interface{},
+				subscribe_result json.RawMessage,
+			) interface{} {
+				var id string
+				json.Unmarshal(subscribe_result, &id)
+				return []string{"sub-" + id}
+			},
+		},
+	)
+
+	descriptor, subscriber1, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subscriber2, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	// descriptor still has subscriber
+	mgr.Unsubscribe(descriptor, subscriber1)
+
+	select {
+	case x := <-upstream.calls:
+		t.Fatal("unexpected call:", x)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mgr.Unsubscribe(descriptor, subscriber2)
+
+	testExpect(t, upstream.calls, `unsubscribe ["sub-a"]`)
+}
+
+func TestSubscriptionMgrRemoteUnsubscribeDefaultParameter(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			RemoteUnsubscribeCommand: "unsubscribe",
+		},
+	)
+
+	descriptor, subscriber, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	mgr.Unsubscribe(descriptor, subscriber)
+
+	testExpect(t, upstream.calls, `unsubscribe "a"`)
+}
+
+// testPoolOptions returns options of pooled mode. messages of upstream
+// have descriptor as first parameter
+func testPoolOptions(pool_size int) *SubscriptionMgrOptions {
+	return &SubscriptionMgrOptions{
+		PoolSize:                 pool_size,
+		RemoteUnsubscribeCommand: "unsubscribe",
+		GetDescriptorForRequest: func(request *jsonrpc2.Request) string {
+			var params []interface{}
+			json.Unmarshal(*request.Params, &params)
+			if len(params) == 0 {
+				return ""
+			}
+			descriptor, _ := params[0].(string)
+			return descriptor
+		},
+	}
+}
+
+func TestSubscriptionMgrPoolRequiresRemoteUnsubscribe(t *testing.T) {
+
+	options := testPoolOptions(1)
+	options.RemoteUnsubscribeCommand = ""
+
+	_, err := NewSubscriptionMgr(options)
+	if err == nil {
+		t.Fatal("pooled mode without RemoteUnsubscribeCommand is accepted")
+	}
+}
+
+func TestSubscriptionMgrPoolRequiresGetDescriptorForRequest(t *testing.T) {
+
+	options := testPoolOptions(1)
+	options.GetDescriptorForRequest = nil
+
+	_, err := NewSubscriptionMgr(options)
+	if err == nil {
+		t.Fatal("pooled mode without GetDescriptorForRequest is accepted")
+	}
+}
+
+func TestSubscriptionMgrPool(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	mgr, received := testSubscriptionMgr(t, upstream, testPoolOptions(1))
+
+	descriptor_a, subscriber_a, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	descriptor_b, subscriber_b, err := mgr.Subscribe(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "b"`)
+
+	if x := atomic.LoadInt64(&upstream.dials); x != 1 {
+		t.Fatal("connection isn't shared:", x)
+	}
+
+	conn := testUpstreamConn(t, upstream)
+	testUpstreamConn(t, upstream)
+
+	var res interface{}
+
+	err = conn.Call(context.Background(), "event", []interface{}{"b", 1}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, received, "b "+subscriber_b+` ["b",1]`)
+
+	err = conn.Call(context.Background(), "event", []interface{}{"a", 2}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, received, "a "+subscriber_a+` ["a",2]`)
+
+	err = conn.Call(context.Background(), "event", []interface{}{"c", 3}, &res)
+	if err == nil {
+		t.Fatal("message of unknown descriptor is accepted")
+	}
+
+	mgr.Unsubscribe(descriptor_a, subscriber_a)
+	testExpect(t, upstream.calls, `unsubscribe "a"`)
+
+	select {
+	case <-conn.DisconnectNotify():
+		t.Fatal("connection is closed while it's used by descriptor")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mgr.Unsubscribe(descriptor_b, subscriber_b)
+	testExpect(t, upstream.calls, `unsubscribe "b"`)
+
+	select {
+	case <-conn.DisconnectNotify():
+	case <-time.After(5 * time.Second):
+		t.Fatal("unused connection isn't closed")
+	}
+
+	_, _, err = mgr.Subscribe(context.Background(), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "c"`)
+
+	if x := atomic.LoadInt64(&upstream.dials); x != 2 {
+		t.Fatal("new connection isn't made:", x)
+	}
+}
+
+// descriptor subscribed while upstream is reconnecting is subscribed
+// only once on new connection
+func TestSubscriptionMgrPoolResubscribeOnce(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	var block_auth int32
+	auth_started := make(chan struct{}, 1)
+	auth_release := make(chan struct{})
+
+	options := testPoolOptions(1)
+	options.ReconnectMinDelay = 10 * time.Millisecond
+	options.Authenticator = func(conn *jsonrpc2.Conn) error {
+		if atomic.LoadInt32(&block_auth) != 0 {
+			auth_started <- struct{}{}
+			<-auth_release
+		}
+		return nil
+	}
+
+	mgr, _ := testSubscriptionMgr(t, upstream, options)
+
+	_, _, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	atomic.StoreInt32(&block_auth, 1)
+	testUpstreamConn(t, upstream).Close()
+
+	select {
+	case <-auth_started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream isn't reconnecting")
+	}
+
+	subscribed := make(chan error, 1)
+	go func() {
+		_, _, err := mgr.Subscribe(context.Background(), "b")
+		subscribed <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(auth_release)
+
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe isn't finished")
+	}
+
+	calls := map[string]int{}
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case x := <-upstream.calls:
+			calls[x]++
+		case <-timeout:
+			done = true
+		}
+	}
+
+	if calls[`subscribe "a"`] != 1 || calls[`subscribe "b"`] != 1 || len(calls) != 2 {
+		t.Fatal("unexpected calls after reconnection:", calls)
+	}
+}
+
+type testSubscribeResult struct {
+	unsubscribing_descriptor string
+	err                      error
+}
+
+func testSubscribeAsync(
+	ctx context.Context,
+	mgr *SubscriptionMgr,
+	parameter string,
+) chan testSubscribeResult {
+	ret := make(chan testSubscribeResult, 1)
+	go func() {
+		_, unsubscribing_descriptor, err := mgr.Subscribe(ctx, parameter)
+		ret <- testSubscribeResult{unsubscribing_descriptor, err}
+	}()
+	return ret
+}
+
+func testSubscribeWait(t *testing.T, c chan testSubscribeResult) testSubscribeResult {
+	t.Helper()
+
+	select {
+	case x := <-c:
+		return x
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe isn't finished")
+	}
+	return testSubscribeResult{}
+}
+
+// testBlockSubscribe makes upstream wait for release before replying to
+// subscription with parameter
+func testBlockSubscribe(upstream *testUpstream, parameter string) chan struct{} {
+	release := make(chan struct{})
+	upstream.before_reply = func(req *jsonrpc2.Request) error {
+		if req.Method == "subscribe" && string(*req.Params) == `"`+parameter+`"` {
+			<-release
+		}
+		return nil
+	}
+	return release
+}
+
+func TestSubscriptionMgrSubscribeDedup(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+	release := testBlockSubscribe(upstream, "a")
+
+	mgr, _ := testSubscriptionMgr(t, upstream, &SubscriptionMgrOptions{})
+
+	results := make([]chan testSubscribeResult, 5)
+	for i := range results {
+		results[i] = testSubscribeAsync(context.Background(), mgr, "a")
+	}
+
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	// other descriptors aren't blocked
+	_, _, err := mgr.Subscribe(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "b"`)
+
+	close(release)
+
+	subscribers := map[string]bool{}
+	for _, i := range results {
+		x := testSubscribeWait(t, i)
+		if x.err != nil {
+			t.Fatal(x.err)
+		}
+		subscribers[x.unsubscribing_descriptor] = true
+	}
+
+	if len(subscribers) != len(results) {
+		t.Fatal("subscribers aren't unique:", subscribers)
+	}
+
+	x, _ := mgr.Subscriptions("a")
+	if len(x) != len(results) {
+		t.Fatal("unexpected subscribers:", x)
+	}
+
+	select {
+	case x := <-upstream.calls:
+		t.Fatal("unexpected call:", x)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionMgrSubscribeLeaderFailure(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	release := make(chan struct{})
+	var calls int32
+	upstream.before_reply = func(req *jsonrpc2.Request) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			return errors.New("subscription failed")
+		}
+		return nil
+	}
+
+	mgr, _ := testSubscriptionMgr(t, upstream, &SubscriptionMgrOptions{})
+
+	leader := testSubscribeAsync(context.Background(), mgr, "a")
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	waiter := testSubscribeAsync(context.Background(), mgr, "a")
+	time.Sleep(50 * time.Millisecond)
+
+	close(release)
+
+	if x := testSubscribeWait(t, leader); x.err == nil {
+		t.Fatal("leader isn't failed")
+	}
+	if x := testSubscribeWait(t, waiter); x.err == nil {
+		t.Fatal("waiter isn't failed")
+	}
+
+	_, _, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal("can't subscribe after failure:", err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+}
+
+// subscription made after leader stopped waiting is kept for waiter
+func TestSubscriptionMgrSubscribeLeaderCancel(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+	release := testBlockSubscribe(upstream, "a")
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			RemoteUnsubscribeCommand: "unsubscribe",
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	leader := testSubscribeAsync(ctx, mgr, "a")
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	waiter := testSubscribeAsync(context.Background(), mgr, "a")
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+
+	if x := testSubscribeWait(t, leader); x.err != context.Canceled {
+		t.Fatal("unexpected error of leader:", x.err)
+	}
+
+	close(release)
+
+	x := testSubscribeWait(t, waiter)
+	if x.err != nil {
+		t.Fatal(x.err)
+	}
+
+	subscribers, _ := mgr.Subscriptions("a")
+	if len(subscribers) != 1 || subscribers[0] != x.unsubscribing_descriptor {
+		t.Fatal("unexpected subscribers:", subscribers)
+	}
+
+	select {
+	case x := <-upstream.calls:
+		t.Fatal("unexpected call:", x)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// subscription made after all calls stopped waiting for it is undone
+func TestSubscriptionMgrSubscribeAllCancel(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+	release := testBlockSubscribe(upstream, "a")
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			RemoteUnsubscribeCommand: "unsubscribe",
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	leader := testSubscribeAsync(ctx, mgr, "a")
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	waiter := testSubscribeAsync(ctx, mgr, "a")
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+
+	for _, i := range []chan testSubscribeResult{leader, waiter} {
+		if x := testSubscribeWait(t, i); x.err != context.Canceled {
+			t.Fatal("unexpected error:", x.err)
+		}
+	}
+
+	close(release)
+
+	testExpect(t, upstream.calls, `unsubscribe "a"`)
+
+	subscribers, _ := mgr.Subscriptions("a")
+	if len(subscribers) != 0 {
+		t.Fatal("unexpected subscribers:", subscribers)
+	}
+}
+
+func TestSubscriptionMgrSubscribeTimeout(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+	release := testBlockSubscribe(upstream, "a")
+	defer close(release)
+
+	mgr, _ := testSubscriptionMgr(
+		t,
+		upstream,
+		&SubscriptionMgrOptions{
+			SubscribeTimeout: 100 * time.Millisecond,
+		},
+	)
+
+	x := testSubscribeWait(t, testSubscribeAsync(context.Background(), mgr, "a"))
+	if x.err != context.DeadlineExceeded {
+		t.Fatal("unexpected error:", x.err)
+	}
+}
+
+func TestSubscriptionMgrSubscribeWaiterCancel(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+	release := testBlockSubscribe(upstream, "a")
+
+	mgr, _ := testSubscriptionMgr(t, upstream, &SubscriptionMgrOptions{})
+
+	leader := testSubscribeAsync(context.Background(), mgr, "a")
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if x := testSubscribeWait(t, testSubscribeAsync(ctx, mgr, "a")); x.err != context.DeadlineExceeded {
+		t.Fatal("unexpected error of waiter:", x.err)
+	}
+
+	close(release)
+
+	x := testSubscribeWait(t, leader)
+	if x.err != nil {
+		t.Fatal(x.err)
+	}
+
+	subscribers, _ := mgr.Subscriptions("a")
+	if len(subscribers) != 1 || subscribers[0] != x.unsubscribing_descriptor {
+		t.Fatal("unexpected subscribers:", subscribers)
+	}
+}
+
+// Subscribe waits for reconnecting upstream instead of subscribing on
+// connection which isn't authenticated yet
+func TestSubscriptionMgrSubscribeWaitsForReconnect(t *testing.T) {
+
+	upstream := newTestUpstream(t)
+
+	var authenticating int32
+	auth_started := make(chan struct{}, 1)
+	auth_release := make(chan struct{})
+
+	upstream.before_reply = func(req *jsonrpc2.Request) error {
+		if atomic.LoadInt32(&authenticating) != 0 {
+			return errors.New("not authenticated")
+		}
+		return nil
+	}
+
+	options := testPoolOptions(1)
+	options.ReconnectMinDelay = 10 * time.Millisecond
+	options.Authenticator = func(conn *jsonrpc2.Conn) error {
+		if atomic.LoadInt32(&authenticating) != 0 {
+			auth_started <- struct{}{}
+			<-auth_release
+			atomic.StoreInt32(&authenticating, 0)
+		}
+		return nil
+	}
+
+	mgr, _ := testSubscriptionMgr(t, upstream, options)
+
+	_, _, err := mgr.Subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExpect(t, upstream.calls, `subscribe "a"`)
+
+	atomic.StoreInt32(&authenticating, 1)
+	testUpstreamConn(t, upstream).Close()
+
+	select {
+	case <-auth_started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream isn't reconnecting")
+	}
+
+	result := testSubscribeAsync(context.Background(), mgr, "b")
+
+	time.Sleep(100 * time.Millisecond)
+	close(auth_release)
+
+	if x := testSubscribeWait(t, result); x.err != nil {
+		t.Fatal(x.err)
+	}
+
+	x, _ := mgr.Subscriptions("a")
+	if len(x) != 1 {
+		t.Fatal("descriptor isn't resubscribed")
+	}
+}
@@ -0,0 +1,99 @@
+package gojsonrpc2server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultWSPath       = "/socket"
+	DefaultWSBufferSize = 1024
+)
+
+func (self *Server) wsPath() string {
+	if self.options.WSPath == "" {
+		return DefaultWSPath
+	}
+	return self.options.WSPath
+}
+
+// makeWSUpgrader creates upgrader from ServerOptions. it's created once and
+// shared by all ListenAtAddressesWS
+func (self *Server) makeWSUpgrader() *websocket.Upgrader {
+
+	read_buffer_size := self.options.WSReadBufferSize
+	if read_buffer_size == 0 {
+		read_buffer_size = DefaultWSBufferSize
+	}
+
+	write_buffer_size := self.options.WSWriteBufferSize
+	if write_buffer_size == 0 {
+		write_buffer_size = DefaultWSBufferSize
+	}
+
+	ret := &websocket.Upgrader{
+		ReadBufferSize:    read_buffer_size,
+		WriteBufferSize:   write_buffer_size,
+		Subprotocols:      self.options.WSSubprotocols,
+		EnableCompression: self.options.WSEnableCompression,
+	}
+
+	// nil CheckOrigin makes gorilla/websocket to accept only same origin
+	// requests and requests without Origin header
+	if self.options.WSAllowedOrigins != nil {
+		allowed := make([]string, len(self.options.WSAllowedOrigins))
+		for i, x := range self.options.WSAllowedOrigins {
+			allowed[i] = strings.TrimRight(strings.TrimSpace(x), "/")
+		}
+		ret.CheckOrigin = func(r *http.Request) bool {
+			ok := checkWSOrigin(r, allowed)
+			if !ok {
+				self.LogError(
+					"http: websocket origin not allowed:",
+					r.Header.Get("Origin"),
+					"from",
+					r.RemoteAddr,
+				)
+			}
+			return ok
+		}
+	}
+
+	return ret
+}
+
+// each of allowed is "*", full origin like "https://example.com:8080" or
+// host like "example.com:8080", which matches any scheme. requests without
+// Origin header (non-browser clients) are allowed
+func checkWSOrigin(r *http.Request, allowed []string) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, x := range allowed {
+		switch {
+		case x == "*":
+			return true
+		case strings.Contains(x, "://"):
+			if strings.EqualFold(x, u.Scheme+"://"+u.Host) {
+				return true
+			}
+		default:
+			if strings.EqualFold(x, u.Host) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
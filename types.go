@@ -19,6 +19,27 @@ type AppContextSession interface {
 	Destroy()
 }
 
+// HandlerFunc handles RPC request. last handler in chain calls
+// AppContextSession.RPCHandle()
+type HandlerFunc func(*RPCHandleContext)
+
+// Interceptor wraps handler with additional processing (auth checks,
+// logging, rate limiting, etc). Interceptor may not call next, if request
+// must not be processed further - in this case it should respond itself
+// (using RPCHandleContext.Responder)
+type Interceptor func(next HandlerFunc) HandlerFunc
+
+// ChainInterceptors combines interceptors into one. first interceptor is
+// outermost (it is called first)
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		for i := len(interceptors) - 1; i != -1; i -= 1 {
+			next = interceptors[i](next)
+		}
+		return next
+	}
+}
+
 type RPCHandleContext struct {
 	Ctx     context.Context
 	Server  *Server
@@ -27,4 +48,11 @@ type RPCHandleContext struct {
 	AppContextSession AppContextSession
 	Conn              *jsonrpc2.Conn
 	Req               *jsonrpc2.Request
+
+	// Responder created by Session for this request. Using it allows Session
+	// to know if handler responded to request
+	Responder *HandleResponder
+
+	// set when request reaches authentication or AppContextSession
+	routed bool
 }